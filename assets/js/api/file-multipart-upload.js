@@ -90,10 +90,19 @@ function FileMultipartUploadApi(config) {
         option = option || {}
         var url = _updateUrl()
         url += '?uploadId=' + this.uploadId
+        // 服务端会按照这个列表校验每个part的ETag并按顺序合并
+        var body = '<CompleteMultipartUpload>'
+        ;(option.data || []).forEach(function (part) {
+            body += '<Part><PartNumber>' + part.PartNumber + '</PartNumber>'
+            body += '<ETag>' + part.ETag + '</ETag></Part>'
+        })
+        body += '</CompleteMultipartUpload>'
         return $.ajax({
             url: url,
             type: 'POST',
-            data: option.data,
+            data: body,
+            contentType: 'application/xml',
+            processData: false,
             async: option.async === undefined ? true : option.async,
             timeout: 0,  // wait forever
         })
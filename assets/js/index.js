@@ -326,6 +326,12 @@ var vm = new Vue({
             type: "dir",
         }],
         myDropzone: null,
+        editing: {
+            path: '',
+            content: '',
+            etag: '',
+            saving: false,
+        },
         filenameSortBy: '',  // ENUM: {'', 'asc', 'desc'}
     },
     computed: {
@@ -593,6 +599,55 @@ var vm = new Vue({
                 }
             })
         },
+        editFile: function (f) {
+            var that = this;
+            var url = pathJoin(["/", location.pathname, encodeURIComponent(f.name)]);
+            $.ajax({
+                url: url,
+                data: {op: "edit"},
+                method: "GET",
+                cache: false,
+                success: function (res) {
+                    that.editing = {
+                        path: url,
+                        content: res.content,
+                        etag: res.etag,
+                        saving: false,
+                    }
+                    $("#edit-title").text(f.name);
+                    $("#edit-modal").modal("show");
+                },
+                error: function (jqXHR, textStatus, errorThrown) {
+                    showErrorMessage(jqXHR)
+                }
+            })
+        },
+        saveEdit: function () {
+            var that = this;
+            this.editing.saving = true;
+            $.ajax({
+                url: this.editing.path + "?op=edit",
+                method: "PUT",
+                data: this.editing.content,
+                processData: false,
+                contentType: "text/plain; charset=utf-8",
+                headers: {"If-Match": this.editing.etag},
+                success: function (res) {
+                    that.editing.saving = false;
+                    that.editing.etag = res.etag;
+                    $("#edit-modal").modal("hide");
+                    loadFileList()
+                },
+                error: function (jqXHR, textStatus, errorThrown) {
+                    that.editing.saving = false;
+                    if (jqXHR.status == 412) {
+                        alert("The file has been changed by someone else, copy your changes and reopen it.")
+                        return
+                    }
+                    showErrorMessage(jqXHR)
+                }
+            })
+        },
         makeDirectory: function () {
             var name = window.prompt("current path: " + decodeURIComponent(location.pathname) + "\nplease enter a new directory name", "")
             console.log(name)
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// at most so many operations in one batch request
+const batchMaxOperations = 1000
+
+// BatchOperation is one item of POST /-/batch, paths are relative to root
+type BatchOperation struct {
+	Op        string `json:"op"` // delete, mkdir, move, copy or unzip
+	Path      string `json:"path"`
+	Dest      string `json:"dest,omitempty"`      // of move and copy
+	Overwrite bool   `json:"overwrite,omitempty"` // of move and copy
+	Link      string `json:"link,omitempty"`      // of copy
+}
+
+type BatchRequest struct {
+	Operations  []BatchOperation `json:"operations"`
+	StopOnError bool             `json:"stopOnError"`
+}
+
+// BatchResult is the result of one operation, in the same order as the request
+type BatchResult struct {
+	Op          string `json:"op"`
+	Path        string `json:"path"`
+	Success     bool   `json:"success"`
+	Skipped     bool   `json:"skipped,omitempty"` // not run because an earlier one failed with stopOnError
+	Code        int    `json:"code"`
+	Description string `json:"description,omitempty"`
+
+	Destination string        `json:"destination,omitempty"`
+	Replaced    bool          `json:"replaced,omitempty"`
+	Copied      *CopyProgress `json:"copied,omitempty"`
+}
+
+// mkdir creates the directory at path with its missing parents
+func (s *HTTPStaticServer) mkdir(req *http.Request, path string) error {
+	auth := s.readAccessConf(path)
+	if !auth.canUpload(req) {
+		return &S3APIError{http.StatusForbidden, "AccessDenied", "Upload forbidden"}
+	}
+	if err := checkRelativePath(multipartKey(path)); err != nil {
+		return &S3APIError{http.StatusForbidden, "InvalidArgument", err.Error()}
+	}
+	dirpath := filepath.Join(s.Root, multipartKey(path))
+	if info, err := os.Stat(dirpath); err == nil && !info.IsDir() {
+		return &S3APIError{http.StatusConflict, "InvalidRequest", "A file with the same name exists."}
+	}
+	if err := os.MkdirAll(dirpath, os.ModePerm); err != nil {
+		return &S3APIError{http.StatusConflict, "InvalidRequest", "Cannot create directory. " + err.Error()}
+	}
+	return nil
+}
+
+func (s *HTTPStaticServer) runBatchOperation(req *http.Request, op BatchOperation) *BatchResult {
+	result := &BatchResult{Op: op.Op, Path: op.Path, Code: http.StatusOK}
+	safe := IsSafePath(op.Path) && (op.Dest == "" || IsSafePath(op.Dest))
+	// 不像url那样经过mux的清理，这里的路径要先规范成相对root的
+	op.Path = multipartKey(op.Path)
+	if op.Dest != "" {
+		op.Dest = multipartKey(op.Dest)
+	}
+	var err error
+	switch {
+	case !safe:
+		err = &S3APIError{http.StatusBadRequest, "InvalidArgument", "Invalid parent directory accessing."}
+	case isTrashPath(op.Path) || (op.Dest != "" && isTrashPath(op.Dest)):
+		err = &S3APIError{http.StatusForbidden, "InvalidArgument", "Name is reserved by gohttpserver"}
+	case (op.Op == "move" || op.Op == "copy") && op.Dest == "":
+		err = &S3APIError{http.StatusBadRequest, "InvalidArgument", "dest is required"}
+	case op.Op == "delete":
+		err = s.deletePath(req, op.Path)
+	case op.Op == "mkdir":
+		err = s.mkdir(req, op.Path)
+	case op.Op == "unzip":
+		err = s.unzip(req, op.Path)
+	case op.Op == "move":
+		result.Destination = op.Dest
+		result.Replaced, err = s.move(req, moveRequest{Src: op.Path, Dst: op.Dest, Overwrite: op.Overwrite})
+	case op.Op == "copy":
+		result.Destination = op.Dest
+		result.Copied, err = s.copy(req, copyRequest{Src: op.Path, Dst: op.Dest, Overwrite: op.Overwrite, Link: op.Link}, nil)
+	default:
+		err = &S3APIError{http.StatusBadRequest, "InvalidArgument", "op should be one of delete, mkdir, move, copy and unzip"}
+	}
+	if err != nil {
+		status, body := uploadErrorJSON(err)
+		if _, ok := err.(*os.PathError); ok {
+			status = http.StatusInternalServerError
+		}
+		result.Code = status
+		result.Description = body["description"].(string)
+		return result
+	}
+	result.Success = true
+	return result
+}
+
+// hBatch runs a list of operations with the permissions of the caller, one by one in order.
+// Every operation is checked like its own request, the response has a result for each.
+//
+//	POST /-/batch {"operations":[{"op":"delete","path":"a.txt"},{"op":"move","path":"b.txt","dest":"c/b.txt"}],"stopOnError":true}
+func (s *HTTPStaticServer) hBatch(w http.ResponseWriter, req *http.Request) {
+	var batch BatchRequest
+	if err := json.NewDecoder(io.LimitReader(req.Body, 2<<20)).Decode(&batch); err != nil {
+		http.Error(w, "Invalid json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(batch.Operations) == 0 || len(batch.Operations) > batchMaxOperations {
+		http.Error(w, "operations should have 1 to 1000 items", http.StatusBadRequest)
+		return
+	}
+
+	results := make([]*BatchResult, 0, len(batch.Operations))
+	success, failed := true, false
+	for _, op := range batch.Operations {
+		if failed && batch.StopOnError {
+			results = append(results, &BatchResult{Op: op.Op, Path: op.Path, Skipped: true})
+			continue
+		}
+		result := s.runBatchOperation(req, op)
+		if !result.Success {
+			success, failed = false, true
+		}
+		results = append(results, result)
+	}
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": success,
+		"results": results,
+	})
+}
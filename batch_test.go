@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatch(t *testing.T) {
+	s := newTestServer(t, map[string]string{"a.txt": "hello"})
+	body := `{"operations":[
+		{"op":"mkdir","path":"dir/sub"},
+		{"op":"copy","path":"a.txt","dest":"dir/b.txt"},
+		{"op":"move","path":"a.txt","dest":"dir/b.txt"},
+		{"op":"delete","path":"dir/b.txt"}
+	],"stopOnError":true}`
+	w := serveTest(s.hBatch, newTestRequest("POST", "/-/batch", strings.NewReader(body)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"success":false`)
+	assert.Contains(t, w.Body.String(), `"code":409`)
+	assert.Contains(t, w.Body.String(), `"skipped":true`)
+	assert.True(t, testFileExists(s, "dir/sub/"))
+	assert.Equal(t, "hello", readTestFile(s, "dir/b.txt"))
+	assert.Equal(t, "hello", readTestFile(s, "a.txt"))
+
+	result := s.runBatchOperation(newTestRequest("POST", "/-/batch", nil), BatchOperation{Op: "mkdir", Path: "../x"})
+	assert.Equal(t, http.StatusBadRequest, result.Code)
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// how copied files share data with their source
+const (
+	copyLinkAuto     = "auto"     // reflink if the filesystem supports it, otherwise copy
+	copyLinkHardlink = "hardlink" // hard link if on the same filesystem, otherwise copy
+	copyLinkNone     = "none"     // always copy the data
+)
+
+// copyRequest is a server side copy of a file or directory, paths are relative to root in slash form
+type copyRequest struct {
+	Src       string
+	Dst       string
+	Overwrite bool   // replace existing files, existing directories are merged
+	Link      string // see copyLink*
+}
+
+// copyItem is a file or directory to be created by the copy
+type copyItem struct {
+	src  string // absolute
+	dst  string
+	rel  string // dst relative to root in slash form
+	info os.FileInfo
+	auth AccessConf // of dst
+}
+
+// CopyProgress is reported while copying, and as the result when finished
+type CopyProgress struct {
+	Files      int64          `json:"files"`
+	TotalFiles int64          `json:"totalFiles"`
+	Bytes      int64          `json:"bytes"`
+	TotalBytes int64          `json:"totalBytes"`
+	Dirs       int64          `json:"dirs"`
+	Methods    map[string]int `json:"methods"` // files by how they are copied: reflink, hardlink or copy
+	Current    string         `json:"current,omitempty"`
+}
+
+// planCopy checks the whole copy like uploads to every destination directory before anything is written.
+// Hidden files, .ghs.yml, internal files and symlinks in the source are skipped.
+func (s *HTTPStaticServer) planCopy(req *http.Request, c copyRequest) (items []copyItem, size, files int64, err error) {
+	src, dst := multipartKey(c.Src), multipartKey(c.Dst)
+	srcRoot := filepath.Join(s.Root, src)
+	srcAuths := make(map[string]AccessConf)
+	dstAuths := make(map[string]AccessConf)
+	readAuth := func(cache map[string]AccessConf, p string) AccessConf {
+		auth, ok := cache[p]
+		if !ok {
+			auth = s.readAccessConf(p)
+			cache[p] = auth
+		}
+		return auth
+	}
+
+	err = filepath.Walk(srcRoot, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		isRoot := p == srcRoot
+		if !isRoot && (isInternalFile(info.Name()) || info.Name() == YAMLCONF) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, _ := filepath.Rel(srcRoot, p)
+		srcRel := path.Join(src, filepath.ToSlash(rel))
+		srcAuth := readAuth(srcAuths, path.Dir(srcRel))
+		if !srcAuth.canAccess(info.Name()) {
+			if isRoot {
+				return errMoveNotFound
+			}
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+
+		item := copyItem{src: p, rel: path.Join(dst, filepath.ToSlash(rel)), info: info}
+		item.dst = filepath.Join(s.Root, item.rel)
+		if err := checkFilename(filepath.Base(item.dst)); err != nil {
+			return &S3APIError{http.StatusForbidden, "InvalidArgument", item.rel + ": " + err.Error()}
+		}
+		if info.IsDir() {
+			item.auth = readAuth(dstAuths, item.rel)
+		} else {
+			item.auth = readAuth(dstAuths, path.Dir(item.rel))
+		}
+		if !item.auth.canUpload(req) {
+			return &S3APIError{http.StatusForbidden, "AccessDenied", "Upload forbidden: " + item.rel}
+		}
+		if dstInfo, err := os.Lstat(item.dst); err == nil {
+			if !c.Overwrite || dstInfo.IsDir() != info.IsDir() {
+				return errDestinationExists
+			}
+		}
+		if info.IsDir() {
+			items = append(items, item)
+			return nil
+		}
+		if err := item.auth.checkExtension(info.Name()); err != nil {
+			return err
+		}
+		if len(item.auth.AllowedMimeTypes) > 0 || item.auth.MaxFileSize > 0 {
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			err = item.auth.checkUploadedFile(f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+		sizeDelta, filesDelta := quotaDelta(item.auth, item.dst, info.Size())
+		size += sizeDelta
+		files += filesDelta
+		items = append(items, item)
+		return nil
+	})
+	if os.IsNotExist(err) {
+		err = errMoveNotFound
+	}
+	return
+}
+
+// copyFile writes a copy of item.src to a pending file, and returns it with how the data is copied
+func copyFile(item copyItem, link string) (*PendingFile, string, error) {
+	dst, err := CreatePendingFile(item.dst)
+	if err != nil {
+		return nil, "", err
+	}
+	if link == copyLinkHardlink && dst.replaceWithLink(item.src) == nil {
+		return dst, "hardlink", nil
+	}
+	src, err := os.Open(item.src)
+	if err != nil {
+		dst.Abort()
+		return nil, "", err
+	}
+	defer src.Close()
+	if link != copyLinkNone && reflink(dst.File, src) == nil {
+		return dst, "reflink", nil
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Abort()
+		return nil, "", err
+	}
+	return dst, "copy", nil
+}
+
+// replaceWithLink makes the pending file a hard link of src.
+// It is safe to share the data since gohttpserver never writes into an existing file,
+// every write (uploads, unzip, versions) goes to a new temp file which is renamed into place.
+func (p *PendingFile) replaceWithLink(src string) error {
+	tmp := p.Name() + ".link"
+	if err := os.Link(src, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, p.Name()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	f, err := os.OpenFile(p.Name(), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	p.File.Close()
+	p.File = f
+	return nil
+}
+
+// copy copies a file or directory recursively on the server, progress is called after every file
+func (s *HTTPStaticServer) copy(req *http.Request, c copyRequest, progress func(*CopyProgress)) (*CopyProgress, error) {
+	src, dst := multipartKey(c.Src), multipartKey(c.Dst)
+	if err := checkOpPath(src); err != nil {
+		return nil, err
+	}
+	if err := checkOpPath(dst); err != nil {
+		return nil, err
+	}
+	if src == dst || strings.HasPrefix(dst, src+"/") {
+		return nil, &S3APIError{http.StatusConflict, "InvalidArgument", "Unable to copy a directory into itself."}
+	}
+	if isPresignGrant(req) {
+		return nil, &S3APIError{http.StatusForbidden, "AccessDenied", "Copy forbidden"}
+	}
+	switch c.Link {
+	case "":
+		c.Link = copyLinkAuto
+	case copyLinkAuto, copyLinkHardlink, copyLinkNone:
+	default:
+		return nil, &S3APIError{http.StatusBadRequest, "InvalidArgument", "link should be one of auto, hardlink and none"}
+	}
+
+	items, size, files, err := s.planCopy(req, c)
+	if err != nil {
+		return nil, err
+	}
+	dstAuth := s.readAccessConf(path.Dir(dst))
+	if err := s.checkQuota(dstAuth, size, files); err != nil {
+		return nil, err
+	}
+
+	p := &CopyProgress{Methods: make(map[string]int)}
+	for _, item := range items {
+		if !item.info.IsDir() {
+			p.TotalFiles++
+			p.TotalBytes += item.info.Size()
+		}
+	}
+	indexes := make([]IndexFileItem, 0, p.TotalFiles)
+	for _, item := range items {
+		if item.info.IsDir() {
+			if err := os.MkdirAll(item.dst, os.ModePerm); err != nil {
+				return p, err
+			}
+			p.Dirs++
+			continue
+		}
+		if err := s.copyOne(item, c.Link, p); err != nil {
+			log.Printf("Copy %s: %v", item.rel, err)
+			s.addIndex(indexes)
+			return p, err
+		}
+		if info, err := os.Stat(item.dst); err == nil {
+			indexes = append(indexes, IndexFileItem{item.rel, info})
+		}
+		if progress != nil {
+			p.Current = item.rel
+			progress(p)
+		}
+	}
+	p.Current = ""
+	s.addIndex(indexes)
+	return p, nil
+}
+
+func (s *HTTPStaticServer) copyOne(item copyItem, link string, p *CopyProgress) error {
+	if err := os.MkdirAll(filepath.Dir(item.dst), os.ModePerm); err != nil {
+		return err
+	}
+	dst, method, err := copyFile(item, link)
+	if err != nil {
+		return err
+	}
+	defer dst.Abort()
+
+	unlock := s.pathLocks.Lock(item.rel)
+	defer unlock()
+	usedSize, usedFiles, err := s.checkQuotaFile(item.auth, dst.File, item.dst)
+	if err != nil {
+		return err
+	}
+	if _, err := s.archiveVersion(item.auth, item.dst); err != nil {
+		return err
+	}
+	if method == "hardlink" {
+		// Commit的chmod会改到源文件上
+		info, _ := dst.Stat()
+		defer func() {
+			if info != nil {
+				os.Chmod(item.src, info.Mode())
+			}
+		}()
+	}
+	if err := dst.Commit(); err != nil {
+		return err
+	}
+	s.addQuotaUsage(item.auth, usedSize, usedFiles)
+	setFileMeta(item.dst, getFileMeta(item.src, item.info))
+	p.Files++
+	p.Bytes += item.info.Size()
+	p.Methods[method]++
+	return nil
+}
+
+// addIndex puts new files into the search index, replacing the old ones of the same path
+func (s *HTTPStaticServer) addIndex(items []IndexFileItem) {
+	if len(items) == 0 {
+		return
+	}
+	dirSizeMu.Lock()
+	defer dirSizeMu.Unlock()
+	added := make(map[string]bool, len(items))
+	for _, item := range items {
+		added[item.Path] = true
+	}
+	indexes := make([]IndexFileItem, 0, len(s.indexes)+len(items))
+	for _, item := range s.indexes {
+		if !added[item.Path] {
+			indexes = append(indexes, item)
+		}
+	}
+	s.indexes = append(indexes, items...)
+	dirSizeMap = make(map[string]int64)
+	dirFilesMap = make(map[string]int64)
+}
+
+// hCopyOp handles POST /nightly/app?op=copy&dest=/release/app
+//
+// overwrite=true replaces existing files, link=hardlink|none changes how data is shared (default reflink when possible),
+// progress=true streams progress as one json per line, the last line is the result.
+func (s *HTTPStaticServer) hCopyOp(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	c := copyRequest{
+		Src:       mux.Vars(req)["path"],
+		Dst:       query.Get("dest"),
+		Overwrite: query.Get("overwrite") == "true",
+		Link:      query.Get("link"),
+	}
+	if !IsSafePath(c.Dst) || strings.Trim(c.Dst, "/") == "" {
+		http.Error(w, "Invalid dest", http.StatusBadRequest)
+		return
+	}
+
+	var progress func(*CopyProgress)
+	streamed := false
+	if query.Get("progress") == "true" {
+		enc := json.NewEncoder(w)
+		flusher, _ := w.(http.Flusher)
+		var last time.Time
+		progress = func(p *CopyProgress) {
+			if time.Since(last) < 200*time.Millisecond && p.Files < p.TotalFiles {
+				return
+			}
+			if !streamed {
+				w.Header().Set("Content-Type", "application/x-ndjson")
+				streamed = true
+			}
+			last = time.Now()
+			enc.Encode(p)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+
+	result, err := s.copy(req, c, progress)
+	body := map[string]interface{}{
+		"success":     err == nil,
+		"source":      multipartKey(c.Src),
+		"destination": multipartKey(c.Dst),
+	}
+	if result != nil {
+		body["files"] = result.Files
+		body["dirs"] = result.Dirs
+		body["bytes"] = result.Bytes
+		body["methods"] = result.Methods
+	}
+	if err != nil {
+		status, errBody := uploadErrorJSON(err)
+		for k, v := range errBody {
+			body[k] = v
+		}
+		// 已经开始返回进度的话状态码发出去了，错误只能放在最后一行里
+		if !streamed {
+			w.Header().Set("Content-Type", "application/json;charset=utf-8")
+			w.WriteHeader(status)
+		}
+	} else if !streamed {
+		w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	}
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopy(t *testing.T) {
+	s := newTestServer(t, map[string]string{
+		"nightly/app/a.txt":                "hello",
+		"nightly/app/lib/b.txt":            "world",
+		"nightly/app/.ghs-versions/a.txt/": "",
+		"nightly/app/" + YAMLCONF:          "upload: true\n",
+	})
+	s.Delete = false
+	req := newTestRequest("POST", "/nightly/app?op=copy", nil)
+	var reported []int64
+	p, err := s.copy(req, copyRequest{Src: "nightly/app", Dst: "release/app"}, func(p *CopyProgress) {
+		reported = append(reported, p.Files)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), p.Files)
+	assert.Equal(t, int64(10), p.Bytes)
+	assert.Equal(t, []int64{1, 2}, reported)
+	assert.Equal(t, "world", readTestFile(s, "release/app/lib/b.txt"))
+	// .ghs.yml and old versions are not copied
+	assert.False(t, testFileExists(s, "release/app/"+YAMLCONF))
+	assert.False(t, testFileExists(s, "release/app/"+versionsDirName))
+	assert.Len(t, s.findIndex("release"), 2)
+
+	_, err = s.copy(req, copyRequest{Src: "nightly/app", Dst: "release/app"}, nil)
+	assert.Equal(t, errDestinationExists, err)
+
+	writeTestFiles(t, s, map[string]string{"nightly/app/a.txt": "hello2"})
+	p, err = s.copy(req, copyRequest{Src: "nightly/app/a.txt", Dst: "release/app/a.txt", Overwrite: true, Link: copyLinkHardlink}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, p.Methods["hardlink"])
+	assert.Equal(t, "hello2", readTestFile(s, "release/app/a.txt"))
+	assert.Len(t, s.findIndex("release"), 2)
+}
+
+func TestCopyHardlinkThenUnzip(t *testing.T) {
+	s := newTestServer(t, map[string]string{"nightly/a.txt": "hello"})
+	req := newTestRequest("POST", "/nightly/a.txt?op=copy", nil)
+	p, err := s.copy(req, copyRequest{Src: "nightly/a.txt", Dst: "release/a.txt", Link: copyLinkHardlink}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, p.Methods["hardlink"])
+
+	// unzip over the copy replaces it instead of writing into the shared data
+	f, err := os.Create(filepath.Join(s.Root, "release/a.zip"))
+	assert.NoError(t, err)
+	zw := zip.NewWriter(f)
+	w, _ := zw.Create("a.txt")
+	w.Write([]byte("unzipped"))
+	zw.Close()
+	f.Close()
+	assert.NoError(t, s.unzip(newTestRequest("POST", "/release/a.zip", nil), "release/a.zip"))
+	assert.Equal(t, "unzipped", readTestFile(s, "release/a.txt"))
+	assert.Equal(t, "hello", readTestFile(s, "nightly/a.txt"))
+	assertNoTempFiles(t, filepath.Join(s.Root, "release"))
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// expectedDigest is a checksum of the uploaded file claimed by the client
+type expectedDigest struct {
+	Header    string // which header it comes from
+	Algorithm string // md5, sha-256 or sha-512
+	Sum       []byte
+}
+
+// parseUploadDigests collects checksums of the upload from request headers.
+// Content-MD5, Repr-Digest and Content-Digest describe the request body,
+// so they are only used when the body is the file itself instead of a multipart form.
+func parseUploadDigests(req *http.Request, rawBody bool) ([]expectedDigest, error) {
+	var digests []expectedDigest
+	if rawBody {
+		if value := req.Header.Get("Content-MD5"); value != "" {
+			sum, err := base64.StdEncoding.DecodeString(value)
+			if err != nil || len(sum) != md5.Size {
+				return nil, fmt.Errorf("Invalid Content-MD5: %s", value)
+			}
+			digests = append(digests, expectedDigest{"Content-MD5", "md5", sum})
+		}
+		// RFC 9530, eg: Repr-Digest: sha-256=:X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=:
+		for _, header := range []string{"Repr-Digest", "Content-Digest"} {
+			values := req.Header.Values(header)
+			if len(values) == 0 {
+				continue
+			}
+			found, err := parseDigestFields(strings.Join(values, ","))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s: %v", header, err)
+			}
+			for _, d := range found {
+				d.Header = header
+				digests = append(digests, d)
+			}
+		}
+	}
+	if value := req.Header.Get("X-Checksum-Sha256"); value != "" {
+		sum, err := hex.DecodeString(strings.TrimSpace(value))
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("Invalid X-Checksum-Sha256: %s", value)
+		}
+		digests = append(digests, expectedDigest{"X-Checksum-Sha256", "sha-256", sum})
+	}
+	return digests, nil
+}
+
+// parseDigestFields parses the structured field dictionary of Repr-Digest and Content-Digest,
+// algorithms not supported are ignored as RFC 9530 allows
+func parseDigestFields(value string) ([]expectedDigest, error) {
+	var digests []expectedDigest
+	for _, member := range strings.Split(value, ",") {
+		member = strings.TrimSpace(member)
+		if member == "" {
+			continue
+		}
+		if i := strings.Index(member, ";"); i >= 0 {
+			member = member[:i] // parameters are not used
+		}
+		kv := strings.SplitN(member, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("bad member %q", member)
+		}
+		algorithm := strings.ToLower(strings.TrimSpace(kv[0]))
+		encoded := strings.TrimSpace(kv[1])
+		if len(encoded) < 2 || encoded[0] != ':' || encoded[len(encoded)-1] != ':' {
+			return nil, fmt.Errorf("%s is not a byte sequence", algorithm)
+		}
+		sum, err := base64.StdEncoding.DecodeString(encoded[1 : len(encoded)-1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", algorithm, err)
+		}
+		h := newDigestHash(algorithm)
+		if h == nil {
+			continue
+		}
+		if len(sum) != h.Size() {
+			return nil, fmt.Errorf("%s has wrong length", algorithm)
+		}
+		digests = append(digests, expectedDigest{Algorithm: algorithm, Sum: sum})
+	}
+	return digests, nil
+}
+
+func newDigestHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case "md5":
+		return md5.New()
+	case "sha-256":
+		return sha256.New()
+	case "sha-512":
+		return sha512.New()
+	}
+	return nil
+}
+
+// uploadDigester hashes the upload while it is written,
+// md5 and sha-256 are always computed so that they can be returned to the client
+type uploadDigester struct {
+	expected []expectedDigest
+	hashes   map[string]hash.Hash
+}
+
+func newUploadDigester(expected []expectedDigest) *uploadDigester {
+	d := &uploadDigester{
+		expected: expected,
+		hashes: map[string]hash.Hash{
+			"md5":     md5.New(),
+			"sha-256": sha256.New(),
+		},
+	}
+	for _, e := range expected {
+		if d.hashes[e.Algorithm] == nil {
+			d.hashes[e.Algorithm] = newDigestHash(e.Algorithm)
+		}
+	}
+	return d
+}
+
+func (d *uploadDigester) Writer() io.Writer {
+	writers := make([]io.Writer, 0, len(d.hashes))
+	for _, h := range d.hashes {
+		writers = append(writers, h)
+	}
+	return io.MultiWriter(writers...)
+}
+
+// Verify compares what is received with every checksum the client sent
+func (d *uploadDigester) Verify() error {
+	for _, e := range d.expected {
+		if sum := d.hashes[e.Algorithm].Sum(nil); !bytes.Equal(sum, e.Sum) {
+			return fmt.Errorf("%s mismatch, %s of received data is %s", e.Header, e.Algorithm, hex.EncodeToString(sum))
+		}
+	}
+	return nil
+}
+
+// Sums returns hex encoded md5 and sha256 of the received data
+func (d *uploadDigester) Sums() map[string]string {
+	return map[string]string{
+		"md5":    hex.EncodeToString(d.hashes["md5"].Sum(nil)),
+		"sha256": hex.EncodeToString(d.hashes["sha-256"].Sum(nil)),
+	}
+}
+
+// ReprDigest is the value of Repr-Digest response header
+func (d *uploadDigester) ReprDigest() string {
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(d.hashes["sha-256"].Sum(nil)) + ":"
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadDigests(t *testing.T) {
+	req := httptest.NewRequest("PUT", "/a.txt", nil)
+	req.Header.Set("Content-MD5", "XUFAKrxLKna5cZ2REBfFkg==")
+	req.Header.Set("Repr-Digest", "unixsum=:AAAA:, sha-256=:LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=:;x=1")
+	req.Header.Set("X-Checksum-Sha256", "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824")
+
+	digests, err := parseUploadDigests(req, true)
+	assert.NoError(t, err)
+	assert.Len(t, digests, 3)
+
+	d := newUploadDigester(digests)
+	io.Copy(d.Writer(), strings.NewReader("hello"))
+	assert.NoError(t, d.Verify())
+	assert.Equal(t, "5d41402abc4b2a76b9719d911017c592", d.Sums()["md5"])
+
+	d = newUploadDigester(digests)
+	io.Copy(d.Writer(), strings.NewReader("hellO"))
+	assert.Error(t, d.Verify())
+
+	// headers of the multipart body are not about the file
+	digests, err = parseUploadDigests(req, false)
+	assert.NoError(t, err)
+	assert.Len(t, digests, 1)
+
+	req.Header.Set("Content-Digest", "sha-256=LPJNul")
+	_, err = parseUploadDigests(req, true)
+	assert.Error(t, err)
+}
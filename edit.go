@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// files larger than this can not be edited online
+const editMaxSize = 2 << 20
+
+// EditFile is the response of GET ?op=edit
+type EditFile struct {
+	Path        string `json:"path"`
+	Content     string `json:"content"`
+	ETag        string `json:"etag"`
+	Size        int64  `json:"size"`
+	ModTime     int64  `json:"mtime"`
+	ContentType string `json:"contentType"`
+	Editable    bool   `json:"editable"` // whether the caller can save it
+}
+
+// isReadProtected reports whether the file can only be read by who can delete in its directory
+func isReadProtected(path string) bool {
+	name := filepath.Base(path)
+	return name == YAMLCONF || name == metaFileName
+}
+
+// isText reports whether data looks like utf-8 text which can be edited in a browser
+func isText(data []byte) bool {
+	return utf8.Valid(data) && bytes.IndexByte(data, 0) < 0
+}
+
+// contentETag is the strong ETag of the content, quoted md5 the same as s3 objects uploaded in one part
+func contentETag(data []byte) string {
+	return fmt.Sprintf("\"%x\"", md5.Sum(data))
+}
+
+// currentETag returns the strong ETag of the file at path, "" if it does not exist or is too large to edit
+func currentETag(path string) (string, os.FileInfo, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return "", nil, nil
+	}
+	if err != nil || info.IsDir() || info.Size() > editMaxSize {
+		return "", info, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", info, err
+	}
+	return contentETag(data), info, nil
+}
+
+// etagMatch compares ETags of If-Match or If-None-Match with etag of the current file, "" if there is none.
+// Only strong comparison is used, a weak ETag never matches.
+func etagMatch(header string, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	for _, value := range strings.Split(header, ",") {
+		value = strings.TrimSpace(value)
+		if value == "*" || value == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// hEdit handles GET /README.md?op=edit, returns the content of a text file with its ETag for hEditSave
+func (s *HTTPStaticServer) hEdit(w http.ResponseWriter, r *http.Request) {
+	path := multipartKey(mux.Vars(r)["path"])
+	auth := s.readAccessConf(path)
+	if isReadProtected(path) && !auth.Delete {
+		http.Error(w, "Security warning, not allowed to read", http.StatusForbidden)
+		return
+	}
+	localPath := filepath.Join(s.Root, path)
+	info, err := os.Stat(localPath)
+	if err != nil || info.IsDir() {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if info.Size() > editMaxSize {
+		http.Error(w, "File is too large to edit", http.StatusRequestEntityTooLarge)
+		return
+	}
+	data, err := ioutil.ReadFile(localPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !isText(data) {
+		http.Error(w, "Only text files can be edited", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	file := &EditFile{
+		Path:     path,
+		Content:  string(data),
+		ETag:     contentETag(data),
+		Size:     info.Size(),
+		ModTime:  info.ModTime().UnixNano() / 1e6,
+		Editable: auth.canUpload(r),
+	}
+	if meta := getFileMeta(localPath, info); meta != nil && meta.ContentType != "" {
+		file.ContentType = meta.ContentType
+	} else {
+		file.ContentType = mime.TypeByExtension(filepath.Ext(path))
+	}
+	w.Header().Set("ETag", file.ETag)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(file)
+}
+
+// hEditSave handles PUT /README.md?op=edit, the body is the new content.
+// If-Match with the ETag from hEdit is required, 412 is returned if the file has been changed since.
+// Use If-None-Match: * to create a new file.
+func (s *HTTPStaticServer) hEditSave(w http.ResponseWriter, req *http.Request) {
+	path := multipartKey(mux.Vars(req)["path"])
+	// body是文件内容，不能被canUpload里的FormValue当成表单读掉
+	req.PostForm = url.Values{}
+	auth := s.readAccessConf(path)
+	if !auth.canUpload(req) {
+		http.Error(w, "Upload forbidden", http.StatusForbidden)
+		return
+	}
+	// 读不了的文件也不能改
+	if isReadProtected(path) && !auth.Delete {
+		http.Error(w, "Security warning, not allowed to read", http.StatusForbidden)
+		return
+	}
+	if err := checkRelativePath(path); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	ifMatch, ifNoneMatch := req.Header.Get("If-Match"), req.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch != "*" {
+		http.Error(w, "If-Match is required, or If-None-Match: * to create a new file", http.StatusPreconditionRequired)
+		return
+	}
+	if req.ContentLength > editMaxSize {
+		http.Error(w, "File is too large to edit", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := auth.checkExtension(filepath.Base(path)); err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	if err := auth.checkFileSize(req.ContentLength); err != nil {
+		writeUploadError(w, err)
+		return
+	}
+
+	localPath := filepath.Join(s.Root, path)
+	if err := os.MkdirAll(filepath.Dir(localPath), os.ModePerm); err != nil {
+		writeUploadError(w, &S3APIError{http.StatusConflict, "InvalidRequest", "Cannot create directory. " + err.Error()})
+		return
+	}
+	dst, err := CreatePendingFile(localPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer dst.Abort()
+	h := md5.New()
+	n, err := io.Copy(io.MultiWriter(dst, h), io.LimitReader(auth.limitReader(req.Body), editMaxSize+1))
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	if n > editMaxSize {
+		http.Error(w, "File is too large to edit", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := auth.checkUploadedFile(dst.File); err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	etag := fmt.Sprintf("\"%x\"", h.Sum(nil))
+
+	// 比较ETag到替换文件之间不能有别人写入
+	unlock := s.pathLocks.Lock(path)
+	defer unlock()
+	current, info, err := currentETag(localPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if info != nil && info.IsDir() {
+		writeUploadError(w, &S3APIError{http.StatusConflict, "InvalidRequest", "A directory with the same name exists."})
+		return
+	}
+	exists := info != nil
+	if (ifMatch != "" && !etagMatch(ifMatch, current)) || (ifNoneMatch == "*" && exists) || etagMatch(ifNoneMatch, current) {
+		if current != "" {
+			w.Header().Set("ETag", current)
+		}
+		http.Error(w, "File has been changed by someone else", http.StatusPreconditionFailed)
+		return
+	}
+	usedSize, usedFiles, err := s.checkQuotaFile(auth, dst.File, localPath)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	// 保留原来的Content-Type和metadata，上传者改成这次保存的人
+	meta := &FileMeta{}
+	if exists {
+		if old := getFileMeta(localPath, info); old != nil {
+			*meta = *old
+		}
+	}
+	meta.Uploader = ""
+	if user := currentUser(req); user != nil {
+		meta.Uploader = user.Email
+	}
+	version, err := s.archiveVersion(auth, localPath)
+	if err != nil {
+		log.Println("Keep version:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := dst.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.addQuotaUsage(auth, usedSize, usedFiles)
+	setFileMeta(localPath, meta)
+	if newInfo, err := os.Stat(localPath); err == nil {
+		s.addIndex([]IndexFileItem{{path, newInfo}})
+	}
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	if !exists {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"path":    path,
+		"etag":    etag,
+		"size":    n,
+		"version": version, // "" if versioning is not enabled
+	})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEtagMatch(t *testing.T) {
+	etag := contentETag([]byte("hello\n"))
+	assert.Equal(t, `"b1946ac92492d2347c6235b4d2611184"`, etag)
+	assert.True(t, etagMatch(etag, etag))
+	assert.True(t, etagMatch(`"x", `+etag, etag))
+	assert.True(t, etagMatch("*", etag))
+	assert.False(t, etagMatch("W/"+etag, etag))
+	assert.False(t, etagMatch("*", ""))
+}
+
+func TestEditFile(t *testing.T) {
+	s := newTestServer(t, map[string]string{"a.md": "hello\n"})
+	edit := func(method, path, body string, header map[string]string) *httptest.ResponseRecorder {
+		req := newTestRequest(method, "/"+path+"?op=edit", strings.NewReader(body))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		if method == "GET" {
+			return serveTest(s.hEdit, req)
+		}
+		return serveTest(s.hEditSave, req)
+	}
+
+	w := edit("GET", "a.md", "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var file EditFile
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &file))
+	assert.Equal(t, "hello\n", file.Content)
+	assert.Equal(t, file.ETag, w.Header().Get("ETag"))
+
+	assert.Equal(t, http.StatusPreconditionRequired, edit("PUT", "a.md", "world\n", nil).Code)
+	w = edit("PUT", "a.md", "world\n", map[string]string{"If-Match": file.ETag})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "world\n", readTestFile(s, "a.md"))
+	// 别人已经改过了
+	w = edit("PUT", "a.md", "again\n", map[string]string{"If-Match": file.ETag, "Content-Type": "application/x-www-form-urlencoded"})
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	assert.Equal(t, contentETag([]byte("world\n")), w.Header().Get("ETag"))
+
+	assert.Equal(t, http.StatusCreated, edit("PUT", "dir/b.txt", "new", map[string]string{"If-None-Match": "*"}).Code)
+	assert.Equal(t, http.StatusPreconditionFailed, edit("PUT", "dir/b.txt", "new", map[string]string{"If-None-Match": "*"}).Code)
+
+	writeTestFiles(t, s, map[string]string{YAMLCONF: "delete: false\n"})
+	assert.Equal(t, http.StatusForbidden, edit("GET", YAMLCONF, "", nil).Code)
+	assert.Equal(t, http.StatusForbidden, edit("PUT", YAMLCONF, "upload: true\n", map[string]string{"If-Match": "*"}).Code)
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
 	"encoding/json"
+	"encoding/xml"
 	"crypto/md5"
 	"errors"
 	"fmt"
@@ -16,8 +18,8 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
-	"math/rand"
 
 	"regexp"
 
@@ -52,9 +54,28 @@ type HTTPStaticServer struct {
 	PlistProxy      string
 	GoogleTrackerID string
 	AuthType        string
-
-	indexes []IndexFileItem
-	m       *mux.Router
+	MultipartExpire time.Duration // abandoned multipart uploads are removed after it, 0 means never
+	Trash           bool          // deleted files are moved to .ghs-trash under root, see trash.go
+	TrashExpire     time.Duration // deleted files are purged after it, 0 means never
+	StagingDir      string        // unfinished uploads are kept here, default is os.TempDir()
+	MinPartSize     int64         // multipart upload parts except the last one must be larger than it
+	MaxPartSize     int64
+	MaxPartCount    int
+	S3              bool   // answer s3 clients with s3 compatible responses
+	S3Domain        string // enables virtual-host style buckets, eg: bucket.<S3Domain>
+	S3Region        string
+	S3Credentials   []S3Credential // access keys for aws signature v4, besides the ones in .ghs.yml
+	S3PresignSecret string         // signs urls generated by /-/presign, random if not set
+
+	indexes   []IndexFileItem
+	multipart     *MultipartRegistry
+	multipartOnce sync.Once
+	tus           *TusRegistry
+	tusOnce       sync.Once
+	pathLocks     keyedMutex
+	quotaUsage    quotaUsage
+	stored        []storedUsage // version stores and trash entries found by the last index, they count in quotas
+	m             *mux.Router
 }
 
 func NewHTTPStaticServer(root string) *HTTPStaticServer {
@@ -68,9 +89,14 @@ func NewHTTPStaticServer(root string) *HTTPStaticServer {
 	log.Printf("root path: %s\n", root)
 	m := mux.NewRouter()
 	s := &HTTPStaticServer{
-		Root:  root,
-		Theme: "black",
-		m:     m,
+		Root:            root,
+		Theme:           "black",
+		MinPartSize:     5 << 20,
+		MaxPartSize:     5 << 30,
+		MaxPartCount:    10000,
+		S3Region:        "us-east-1",
+		S3PresignSecret: newPresignSecret(),
+		m:               m,
 	}
 
 	go func() {
@@ -85,19 +111,47 @@ func NewHTTPStaticServer(root string) *HTTPStaticServer {
 		}
 	}()
 
+	go func() {
+		time.Sleep(1 * time.Second)
+		for {
+			s.reapMultipartUploads()
+			s.reapTusUploads()
+			s.reapTrash()
+			time.Sleep(time.Minute * 10)
+		}
+	}()
+
 	// 暂不支持ipa和apk扫码安装
 	// routers for Apple *.ipa
 	// m.HandleFunc("/-/ipa/plist/{path:.*}", s.hPlist)
 	// m.HandleFunc("/-/ipa/link/{path:.*}", s.hIpaLink)
 
+	m.HandleFunc("/-/presign", s.hPresign).Methods("POST")
+	m.HandleFunc("/-/tus/", s.hTus)
+	m.HandleFunc("/-/tus/{id}", s.hTus)
+	m.HandleFunc("/-/trash", s.hTrash).Methods("GET", "DELETE")
+	m.HandleFunc("/-/trash/{id}", s.hTrash).Methods("GET", "POST", "DELETE")
+	m.HandleFunc("/-/batch", s.hBatch).Methods("POST")
 	m.HandleFunc("/{path:.*}", s.hIndex).Methods("GET", "HEAD")		// HEAD这里只兼容调试，正式环境不会有HEAD
 	m.HandleFunc("/{path:.*}", s.hUploadOrMkdir).Methods("POST")
 	m.HandleFunc("/{path:.*}", s.hUploadOrMkdir).Methods("PUT")		// 与post一样，唯一区别是可以覆盖已存在的文件，从界面上传默认都为put
 	m.HandleFunc("/{path:.*}", s.hDelete).Methods("DELETE")
+	m.HandleFunc("/{path:.*}", s.hMove).Methods("MOVE")		// WebDAV
 	return s
 }
 
 func (s *HTTPStaticServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// 签名是按客户端发出的url计算的，要在rewrite之前校验
+	r, err := s.authenticateS3(r)
+	if err != nil {
+		writeS3APIError(w, r, err)
+		return
+	}
+	// virtual-host style s3 request, rewrite to path-style: bucket.s3.example.com/key -> /bucket/key
+	if bucket := s.s3VirtualHostBucket(r); bucket != "" {
+		r.URL.Path = "/" + bucket + r.URL.Path
+		r.URL.RawPath = ""
+	}
 	s.m.ServeHTTP(w, r)
 }
 
@@ -109,6 +163,36 @@ func (s *HTTPStaticServer) hIndex(w http.ResponseWriter, r *http.Request) {
 	}
 
 	relPath := filepath.Join(s.Root, path)
+
+	// 回收站只能通过/-/trash访问
+	if isTrashPath(path) {
+		http.Error(w, "Security warning, not allowed to read", http.StatusForbidden)
+		return
+	}
+	// 历史版本只有能删除的人才能直接访问
+	if isVersionPath(path) {
+		auth := s.readAccessConf(path)
+		if !auth.canDelete(r) {
+			http.Error(w, "Security warning, not allowed to read", http.StatusForbidden)
+			return
+		}
+	}
+
+	// s3 multipart uploads handlers
+	query := r.URL.Query()
+	if uploadId := query.Get("uploadId"); uploadId != "" {
+		s.hS3ListParts(w, r, uploadId)
+		return
+	}
+	if _, exists := query["uploads"]; exists {
+		s.hS3ListMultipartUploads(w, r)
+		return
+	}
+	if s.isS3Request(r) {
+		s.hS3Get(w, r)
+		return
+	}
+
 	if r.FormValue("json") == "true" {
 		s.hJSONList(w, r)
 		return
@@ -128,6 +212,19 @@ func (s *HTTPStaticServer) hIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.FormValue("op") == "versions" {
+		s.hVersions(w, r)
+		return
+	}
+	if version := r.FormValue("version"); version != "" {
+		s.hVersionDownload(w, r, version)
+		return
+	}
+	if r.FormValue("op") == "edit" {
+		s.hEdit(w, r)
+		return
+	}
+
 	log.Println("GET", path, relPath)
 	if r.FormValue("raw") == "false" || isDir(relPath) {
 		if r.Method == "HEAD" {
@@ -135,13 +232,18 @@ func (s *HTTPStaticServer) hIndex(w http.ResponseWriter, r *http.Request) {
 		}
 		renderHTML(w, "index.html", s)
 	} else {
-		if filepath.Base(path) == YAMLCONF {
+		if isReadProtected(path) {
 			auth := s.readAccessConf(path)
 			if !auth.Delete {
 				http.Error(w, "Security warning, not allowed to read", http.StatusForbidden)
 				return
 			}
 		}
+		if info, err := os.Stat(relPath); err == nil {
+			if meta := getFileMeta(relPath, info); meta != nil {
+				meta.setHeaders(w.Header())
+			}
+		}
 		if r.FormValue("download") == "true" {
 			w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(filepath.Base(path)))
 		}
@@ -163,32 +265,69 @@ func (s *HTTPStaticServer) hDelete(w http.ResponseWriter, req *http.Request) {
 		s.hS3AbortMultipartUploads(w, req, uploadId)
 		return
 	}
+	if s.isS3Request(req) {
+		s.hS3Delete(w, req)
+		return
+	}
 
+	if err := s.deletePath(req, path); err != nil {
+		if e, ok := err.(*S3APIError); ok {
+			http.Error(w, e.Message, e.Status)
+			return
+		}
+		pathErr, ok := err.(*os.PathError)
+		if ok{
+			http.Error(w, pathErr.Op + " " + path + ": " + pathErr.Err.Error(), http.StatusInternalServerError)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deletePath deletes a file or directory, it goes to the trash or the version store if enabled
+func (s *HTTPStaticServer) deletePath(req *http.Request, path string) error {
 	// can delete file and directory
 	auth := s.readAccessConf(path)
 	if !auth.canDelete(req) {
-		http.Error(w, "Delete forbidden", http.StatusForbidden)
-		return
+		return &S3APIError{http.StatusForbidden, "AccessDenied", "Delete forbidden"}
 	}
 
 	// 不允许直接删掉整个根目录
 	if path == "/" || path == "" || path == "." {
-		http.Error(w, "Unable to delete bucket root.", http.StatusForbidden)
-		return
+		return &S3APIError{http.StatusForbidden, "InvalidArgument", "Unable to delete bucket root."}
+	}
+	if isTrashPath(path) {
+		return &S3APIError{http.StatusForbidden, "InvalidArgument", "Use /-/trash to purge deleted files"}
 	}
 
 	dst := filepath.Join(s.Root, path)
-	err := os.RemoveAll(dst)
-	if err != nil {
-		pathErr, ok := err.(*os.PathError)
-		if ok{
-			http.Error(w, pathErr.Op + " " + path + ": " + pathErr.Err.Error(), http.StatusInternalServerError)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	var err error
+	if auth.Versioning.Enable && isFile(dst) && !isReadProtected(dst) {
+		// 开启了版本管理的目录，删除的文件放到历史版本里，.ghs.yml除外
+		unlock := s.pathLocks.Lock(multipartKey(path))
+		if _, err = s.archiveVersion(auth, dst); err == nil {
+			err = os.Remove(dst)
+			removeFileMeta(dst)
+		}
+		unlock()
+	} else if s.Trash {
+		if _, err = os.Lstat(dst); err == nil {
+			_, err = s.moveToTrash(path, req)
+		} else if os.IsNotExist(err) {
+			err = nil // same as RemoveAll
+		}
+	} else {
+		// 版本和回收站里的文件还算在quota里，真正删掉的才减掉
+		size, files := pathUsage(dst)
+		err = os.RemoveAll(dst)
+		if err == nil {
+			removeFileMeta(dst)
+			s.addQuotaUsage(auth, -size, -files)
 		}
-		return
 	}
-	w.WriteHeader(http.StatusNoContent)
+	return err
 }
 
 func (s *HTTPStaticServer) hCalculateMd5(w http.ResponseWriter, req *http.Request) {
@@ -233,215 +372,520 @@ func (s *HTTPStaticServer) hCalculateMd5(w http.ResponseWriter, req *http.Reques
 	})
 }
 
+// multipartUploads returns the upload session registry, which is opened on first use
+// so that StagingDir can be set after NewHTTPStaticServer
+func (s *HTTPStaticServer) multipartUploads() *MultipartRegistry {
+	s.multipartOnce.Do(func() {
+		stagingDir := s.StagingDir
+		if stagingDir == "" {
+			stagingDir = os.TempDir()
+		}
+		s.multipart = NewMultipartRegistry(filepath.Join(stagingDir, ".ghs-mpu-temp"))
+	})
+	return s.multipart
+}
+
+// multipartKey returns the object key of the request path, upload sessions are bound to it
+func multipartKey(path string) string {
+	return strings.TrimPrefix(filepath.ToSlash(filepath.Clean("/"+path)), "/")
+}
+
+func multipartOwner(req *http.Request) string {
+	if user := currentUser(req); user != nil {
+		return user.Email
+	}
+	return ""
+}
+
+// s3CanUpload checks upload permission of the request path, multipart uploads share it with PutObject
+func (s *HTTPStaticServer) s3CanUpload(w http.ResponseWriter, req *http.Request) bool {
+	auth := s.readAccessConf(mux.Vars(req)["path"])
+	if !auth.canUpload(req) {
+		writeS3Error(w, req, http.StatusForbidden, "AccessDenied", "Access Denied")
+		return false
+	}
+	return true
+}
+
+// lookupMultipartUpload makes sure uploadId exists, belongs to the request path and to the requester
+func (s *HTTPStaticServer) lookupMultipartUpload(w http.ResponseWriter, req *http.Request, uploadId string) (*MultipartUpload, bool) {
+	path := mux.Vars(req)["path"]
+	u, err := s.multipartUploads().Get(uploadId)
+	if err != nil || u.Key != multipartKey(path) {
+		writeS3Error(w, req, http.StatusNotFound, "NoSuchUpload", errNoSuchUpload.Error())
+		return nil, false
+	}
+	if u.Owner != "" && u.Owner != multipartOwner(req) {
+		writeS3Error(w, req, http.StatusForbidden, "AccessDenied", "The multipart upload was initiated by another user.")
+		return nil, false
+	}
+	return u, true
+}
+
 func (s *HTTPStaticServer) hS3InitiateMultipartUploads(w http.ResponseWriter, req *http.Request) {
 	log.Println("handling s3 initiate multipart uploads")
+	if !s.s3CanUpload(w, req) {
+		return
+	}
 
-	respInitiateMultipartUploadResultTpl := `
-		<?xml version="1.0" encoding="UTF-8"?>
-		<InitiateMultipartUploadResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">
-			<Bucket>%s</Bucket>
-			<Key>%s</Key>
-			<UploadId>%s</UploadId>
-		</InitiateMultipartUploadResult>
-	`
-
-	bucket := strings.Split(req.Host, ".")[0]
-	key := strings.TrimLeft(req.URL.Path, "/")
-	uploadId := fmt.Sprintf("%06d", rand.Intn(999999))
-	resp := fmt.Sprintf(respInitiateMultipartUploadResultTpl, bucket, key, uploadId)
-	resp = strings.TrimSpace(resp)
+	meta, err := fileMetaFromRequest(req, req.Header.Get("Content-Type"))
+	if err != nil {
+		writeS3Error(w, req, http.StatusBadRequest, "MetadataTooLarge", err.Error())
+		return
+	}
+	path := mux.Vars(req)["path"]
+	if err := checkRelativePath(multipartKey(path)); err != nil {
+		writeS3Error(w, req, http.StatusBadRequest, "InvalidArgument", err.Error())
+		return
+	}
+	auth := s.readAccessConf(path)
+	if err := auth.checkExtension(path); err != nil {
+		writeS3APIError(w, req, err)
+		return
+	}
+	u, err := s.multipartUploads().Create(multipartKey(path), multipartOwner(req), *meta)
+	if err != nil {
+		log.Println("Create multipart upload:", err)
+		writeS3Error(w, req, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
 
+	bucket, key := splitBucketKey(u.Key)
 	w.Header().Set("Connection", "keep-alive")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(resp))
+	writeS3XML(w, http.StatusOK, InitiateMultipartUploadResult{
+		Bucket:   bucket,
+		Key:      key,
+		UploadId: u.UploadId,
+	})
 }
 
 func (s *HTTPStaticServer) hS3UploadPart(w http.ResponseWriter, req *http.Request, partNumber, uploadId string) {
 	log.Println("handling s3 upload part")
 
-	if _, err := strconv.Atoi(partNumber); err != nil || partNumber == "" || uploadId == "" {
-		http.Error(w, "Invalid `partNumber` or `uploadId`.", http.StatusBadRequest)
+	partNum, err := strconv.Atoi(partNumber)
+	if err != nil || partNum < 1 || partNum > s.MaxPartCount {
+		writeS3Error(w, req, http.StatusBadRequest, "InvalidArgument", fmt.Sprintf("Part number must be an integer between 1 and %d, inclusive.", s.MaxPartCount))
 		return
 	}
-
-	path := mux.Vars(req)["path"]
-	if !IsSafePath(path) {
-		http.Error(w, "Invalid parent directory accessing.", http.StatusBadRequest)
+	if req.Header.Get("X-Amz-Copy-Source") != "" {
+		writeS3Error(w, req, http.StatusNotImplemented, "NotImplemented", "UploadPartCopy is not supported.")
 		return
 	}
-
-	filename := filepath.Base(path)
-	dirname := filepath.Dir(path)
-	dirpath := filepath.Join(s.Root, dirname)
-	partedFilename := fmt.Sprintf(".%s-%s.part-%s", filename, uploadId, partNumber)
-	
-	if !IsExists(dirpath) {
-		if err := os.MkdirAll(dirpath, os.ModePerm); err != nil {
-			log.Println("Create directory:", err)
-			w.Header().Set("Connection", "close")
-			http.Error(w, "Cannot create directory. " + err.Error(), http.StatusConflict)
-			return
-		}
+	if !s.s3CanUpload(w, req) {
+		return
 	}
-
-	file := req.Body
-	if file == nil {
-		http.Error(w, "Empty parted upload body.", http.StatusBadRequest)
+	u, ok := s.lookupMultipartUpload(w, req, uploadId)
+	if !ok {
 		return
 	}
-
-	tempdir := filepath.Join(os.TempDir(), ".ghs-mpu-temp", uploadId)
-	if err := os.MkdirAll(tempdir, os.ModePerm); err != nil {
-		log.Println("Create directory:", err)
+	file, contentLength := s3RequestBody(req)
+	if contentLength > s.MaxPartSize {
 		w.Header().Set("Connection", "close")
-		http.Error(w, "Cannot create directory. " + err.Error(), http.StatusConflict)
+		writeS3EntitySizeError(w, req, "EntityTooLarge", contentLength, s.MaxPartSize)
+		return
+	}
+	if file == nil {
+		http.Error(w, "Empty parted upload body.", http.StatusBadRequest)
 		return
 	}
-	dstPath := filepath.Join(tempdir, partedFilename)
-	dst, err := os.Create(dstPath)
+
+	// 先写到临时文件再rename，同一个part重传时不会互相覆盖出半截数据
+	dst, err := ioutil.TempFile(u.dir, "part-*.tmp")
 	if err != nil {
 		log.Println("Create file:", err)
 		w.Header().Set("Connection", "close")
 		http.Error(w, "File create " + err.Error(), http.StatusConflict)
 		return
 	}
-	if _, err := io.Copy(dst, file); err != nil {
+	// chunked上传时没有Content-Length，多读1个字节来判断是否超过大小限制
+	h := md5.New()
+	size, err := io.Copy(io.MultiWriter(dst, h), io.LimitReader(file, s.MaxPartSize+1))
+	dst.Close()  // 主动关闭，不要defer，避免之后fd还处于打开状态导致别的实例读不了
+	if err == nil && size > s.MaxPartSize {
+		os.Remove(dst.Name())
+		w.Header().Set("Connection", "close")
+		writeS3EntitySizeError(w, req, "EntityTooLarge", size, s.MaxPartSize)
+		return
+	}
+	if err != nil {
 		log.Println("Handle upload file:", err)
-		log.Printf("%v %v\n", dstPath, req.Header.Get("Content-Length"))
+		log.Printf("%v %v\n", dst.Name(), req.Header.Get("Content-Length"))
+		os.Remove(dst.Name())
 		w.Header().Set("Connection", "close")
+		if _, ok := err.(*S3APIError); ok {
+			writeS3APIError(w, req, err) // 签名或者sha256校验失败
+			return
+		}
 		http.Error(w, err.Error(), http.StatusConflict)
 		return
 	}
-	dst.Close()  // 主动关闭，不要defer，避免之后fd还处于打开状态导致别的实例读不了
-
-	dummyEtag := fmt.Sprintf("\"dummy-etag-%06d\"", rand.Intn(999999))
+	// rename和登记要在同一把锁里完成，complete和abort不会看到不在记录里的part文件
+	unlock := s.multipartUploads().locks.Lock(uploadId)
+	defer unlock()
+	if _, err := s.multipartUploads().Get(uploadId); err != nil {
+		// completed or aborted while receiving the part
+		os.Remove(dst.Name())
+		writeS3Error(w, req, http.StatusNotFound, "NoSuchUpload", err.Error())
+		return
+	}
+	if err := os.Rename(dst.Name(), u.partPath(partNum)); err != nil {
+		os.Remove(dst.Name())
+		w.Header().Set("Connection", "close")
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	etag := fmt.Sprintf("%x", h.Sum(nil))
+	err = s.multipartUploads().AddPart(uploadId, &MultipartPart{
+		PartNumber:   partNum,
+		Size:         size,
+		ETag:         etag,
+		LastModified: time.Now(),
+	})
+	if err != nil {
+		writeS3Error(w, req, http.StatusNotFound, "NoSuchUpload", err.Error())
+		return
+	}
 
 	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("ETag", dummyEtag)
+	w.Header().Set("ETag", strconv.Quote(etag))
 	w.WriteHeader(http.StatusOK)  // Set完所有headers后才能调用WriteHeader
 }
 
 func (s *HTTPStaticServer) hS3CompleteMultipartUploads(w http.ResponseWriter, req *http.Request, uploadId string) {
 	log.Println("handling s3 complete multipart upload")
+	if !s.s3CanUpload(w, req) {
+		return
+	}
+
+	// 同一个文件的合并要串行，重复提交的complete等前一个结束后会因为upload已经不存在而失败
+	unlock := s.pathLocks.Lock(multipartKey(mux.Vars(req)["path"]))
+	defer unlock()
+	// 合并期间不能有part重传或者abort
+	unlockUpload := s.multipartUploads().locks.Lock(uploadId)
+	defer unlockUpload()
 
-	if uploadId == "" {
-		http.Error(w, "Invalid empty `uploadId`.", http.StatusBadRequest)
+	u, ok := s.lookupMultipartUpload(w, req, uploadId)
+	if !ok {
 		return
 	}
 
-	path := mux.Vars(req)["path"]
-	if !IsSafePath(path) {
-		http.Error(w, "Invalid parent directory accessing.", http.StatusBadRequest)
+	// 按客户端提交的part列表合并，而不是把收到的part全部拼起来，缺失或错误的part直接拒绝
+	var body CompleteMultipartUpload
+	if err := xml.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeS3Error(w, req, http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema.")
+		return
+	}
+	parts, err := u.CompleteParts(body.Parts, s.MinPartSize)
+	if err != nil {
+		writeS3APIError(w, req, err)
 		return
 	}
 
+	path := mux.Vars(req)["path"]
+	if err := checkRelativePath(multipartKey(path)); err != nil {
+		writeS3Error(w, req, http.StatusBadRequest, "InvalidArgument", err.Error())
+		return
+	}
 	filename := filepath.Base(path)
 	dirname := filepath.Dir(path)
 	dirpath := filepath.Join(s.Root, dirname)
-	partedFilenames := fmt.Sprintf(".%s-%s.part-*", filename, uploadId)
 
-	tempdir := filepath.Join(os.TempDir(), ".ghs-mpu-temp", uploadId)
-	matches, err := filepath.Glob(filepath.Join(tempdir, partedFilenames))
-	if err != nil {
-		http.Error(w, "Invalid multipart upload parts. " + err.Error(), http.StatusBadRequest)
+	// .ghs.yml可能在上传过程中改过，合并前再检查一次上传限制
+	auth := s.readAccessConf(path)
+	var size int64
+	for _, part := range parts {
+		size += part.Size
+	}
+	if err := auth.checkExtension(filename); err != nil {
+		writeS3APIError(w, req, err)
+		return
+	}
+	if err := auth.checkFileSize(size); err != nil {
+		writeS3APIError(w, req, err)
+		return
+	}
+	if err := s.checkQuotaSize(auth, filepath.Join(dirpath, filename), size); err != nil {
+		writeS3APIError(w, req, err)
 		return
 	}
 
+	if !IsExists(dirpath) {
+		if err := os.MkdirAll(dirpath, os.ModePerm); err != nil {
+			log.Println("Create directory:", err)
+			w.Header().Set("Connection", "close")
+			http.Error(w, "Cannot create directory. " + err.Error(), http.StatusConflict)
+			return
+		}
+	}
+
+	// 先合并到同目录下的临时文件，全部成功后再rename覆盖目标文件
+	// 合并过程中下载的人看到的还是旧文件，合并失败旧文件也不受影响
 	dstPath := filepath.Join(dirpath, filename)
-	dst, err := os.Create(dstPath)
+	dst, err := CreatePendingFile(dstPath)
 	if err != nil {
 		log.Println("Create file:", err)
 		w.Header().Set("Connection", "close")
 		http.Error(w, "File create " + err.Error(), http.StatusConflict)
 		return
 	}
-	defer dst.Close()
+	defer dst.Abort()
 
 	// 逐个part文件合并
-	for i := 1; i <= len(matches); i += 1 {
-		srcFilename := fmt.Sprintf(".%s-%s.part-%d", filename, uploadId, i)
-		srcPath := filepath.Join(tempdir, srcFilename)
-		fmt.Printf("[s3-merge] open source parted file: %s\n", srcPath)
-		src, err := os.Open(srcPath)
+	for _, part := range parts {
+		src, err := os.Open(u.partPath(part.PartNumber))
 		if err != nil {
-			fmt.Printf("[s3-merge err] %s\n", err.Error())
+			log.Printf("Merge part %d of %s: %v", part.PartNumber, u.Key, err)
 			w.Header().Set("Connection", "close")
 			http.Error(w, err.Error(), http.StatusConflict)   // 不能用timeout，可能会导致客户端自动重发请求，这样会重复merge导致更严重错误
 			return
 		}
-		defer func() {
-			if src != nil {
-				src.Close()
-			}
-
-			// 删除parted files
-			os.Remove(srcPath)
-		}()
-
-		fmt.Printf("[s3-merge] start copying source parted file: %s\n", srcPath)
-		if _, err := io.Copy(dst, src); err != nil {
+		_, err = io.Copy(dst, src)
+		src.Close()
+		if err != nil {
+			log.Printf("Merge part %d of %s: %v", part.PartNumber, u.Key, err)
 			w.Header().Set("Connection", "close")
 			http.Error(w, err.Error(), http.StatusConflict)
 			return
 		}
-		fmt.Printf("[s3-merge] finish copying source parted file: %s\n", srcPath)
+	}
+	if err := auth.checkUploadedFile(dst.File); err != nil {
+		writeS3APIError(w, req, err)
+		return
+	}
+	usedSize, usedFiles, err := s.checkQuotaFile(auth, dst.File, dstPath)
+	if err != nil {
+		writeS3APIError(w, req, err)
+		return
+	}
+	if _, err := s.archiveVersion(auth, dstPath); err != nil {
+		writeS3APIError(w, req, err)
+		return
+	}
+	if err := dst.Commit(); err != nil {
+		log.Println("Commit merged file:", err)
+		w.Header().Set("Connection", "close")
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	s.addQuotaUsage(auth, usedSize, usedFiles)
+
+	// 合并完成后删除parted files和session记录
+	if err := s.multipartUploads().Remove(uploadId); err != nil {
+		log.Printf("Remove multipart upload %s: %v", uploadId, err)
 	}
 
-	responseTpl := `
-		<?xml version="1.0" encoding="UTF-8"?>
-		<CompleteMultipartUploadResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">
-			<Location>%s</Location>
-			<Bucket>%s</Bucket>
-			<Key>%s</Key>
-			<ETag>"dummy-etag"</ETag>
-		</CompleteMultipartUploadResult>
-	`
 	scheme := req.Header.Get("X-Forwarded-Proto")
 	if scheme == "" {
 		scheme = "http"
 	}
-	bucket := strings.Split(req.Host, ".")[0]
-	key := strings.TrimLeft(req.URL.Path, "/")
-	location := fmt.Sprintf("%s://%s%s", scheme, req.Host, key)
-	resp := fmt.Sprintf(responseTpl, location, bucket, key)
-	resp = strings.TrimSpace(resp)
+	etag := compositeETag(parts)
+	setFileETag(dstPath, etag)
+	setFileMeta(dstPath, &u.Meta)
+	bucket, key := splitBucketKey(u.Key)
 
 	w.Header().Set("Connection", "close")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(resp))
+	w.Header().Set("ETag", strconv.Quote(etag))
+	writeS3XML(w, http.StatusOK, CompleteMultipartUploadResult{
+		Location: fmt.Sprintf("%s://%s%s", scheme, req.Host, req.URL.Path),
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     strconv.Quote(etag),
+	})
 }
 
 func (s *HTTPStaticServer) hS3AbortMultipartUploads(w http.ResponseWriter, req *http.Request, uploadId string) {
 	log.Printf("handling s3 abort multipart upload")
-
-	if uploadId == "" {
-		http.Error(w, "Invalid empty `uploadId`.", http.StatusBadRequest)
+	if !s.s3CanUpload(w, req) {
 		return
 	}
 
-	path := mux.Vars(req)["path"]
-	if !IsSafePath(path) {
-		http.Error(w, "Invalid parent directory accessing.", http.StatusBadRequest)
+	u, ok := s.lookupMultipartUpload(w, req, uploadId)
+	if !ok {
 		return
 	}
 
-	tempdir := filepath.Join(os.TempDir(), ".ghs-mpu-temp", uploadId)
-
-	// 删除parted files
+	// 删除parted files和session记录
 	// 但不删除本体，包括合并了一半的文件，因为可能只是上传parted过程中出错，删除本体的话会导致原本的文件被删除
 	defer func() {
-		if err := os.RemoveAll(tempdir); err != nil {
+		unlock := s.multipartUploads().locks.Lock(uploadId)
+		defer unlock()
+		if err := s.multipartUploads().Remove(uploadId); err != nil {
 			// 如果删不掉，可能是目录上传parted的请求占用着还没来得及释放
 			// 需要等其他upload线程都彻底断开并释放了文件句柄，不然的话可能会删不掉文件
 			// 所以这里等4s，这个sleep不会阻塞其他线程
 			time.Sleep(4 * time.Second)
-			os.RemoveAll(tempdir)
+			os.RemoveAll(u.dir)
 		}
 	}()
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func multipartOwnerXML(owner string) S3Owner {
+	if owner == "" {
+		owner = "anonymous"
+	}
+	return S3Owner{ID: owner, DisplayName: owner}
+}
+
+// parseMaxItems parses s3 max-parts/max-uploads query, default and upper limit is 1000
+func parseMaxItems(value string) (int, bool) {
+	if value == "" {
+		return 1000, true
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	if n > 1000 {
+		n = 1000
+	}
+	return n, true
+}
+
+func (s *HTTPStaticServer) hS3ListParts(w http.ResponseWriter, req *http.Request, uploadId string) {
+	if !s.s3CanUpload(w, req) {
+		return
+	}
+	u, ok := s.lookupMultipartUpload(w, req, uploadId)
+	if !ok {
+		return
+	}
+
+	query := req.URL.Query()
+	maxParts, ok := parseMaxItems(query.Get("max-parts"))
+	if !ok {
+		writeS3Error(w, req, http.StatusBadRequest, "InvalidArgument", "Invalid max-parts.")
+		return
+	}
+	marker, _ := strconv.Atoi(query.Get("part-number-marker"))
+
+	bucket, key := splitBucketKey(u.Key)
+	result := ListPartsResult{
+		Bucket:           bucket,
+		Key:              key,
+		UploadId:         u.UploadId,
+		Initiator:        multipartOwnerXML(u.Owner),
+		Owner:            multipartOwnerXML(u.Owner),
+		StorageClass:     "STANDARD",
+		PartNumberMarker: marker,
+		MaxParts:         maxParts,
+		Parts:            make([]S3Part, 0),
+	}
+	for _, part := range u.SortedParts() {
+		if part.PartNumber <= marker {
+			continue
+		}
+		if len(result.Parts) >= maxParts {
+			result.IsTruncated = true
+			break
+		}
+		result.Parts = append(result.Parts, S3Part{
+			PartNumber:   part.PartNumber,
+			LastModified: part.LastModified.UTC().Format(s3TimeFormat),
+			ETag:         strconv.Quote(part.ETag),
+			Size:         part.Size,
+		})
+		result.NextPartNumberMarker = part.PartNumber
+	}
+	writeS3XML(w, http.StatusOK, result)
+}
+
+func (s *HTTPStaticServer) hS3ListMultipartUploads(w http.ResponseWriter, req *http.Request) {
+	// upload id是上传分片和取消上传的凭证，只有能上传的人才能看到
+	if !s.s3CanUpload(w, req) {
+		return
+	}
+	query := req.URL.Query()
+	maxUploads, ok := parseMaxItems(query.Get("max-uploads"))
+	if !ok {
+		writeS3Error(w, req, http.StatusBadRequest, "InvalidArgument", "Invalid max-uploads.")
+		return
+	}
+
+	// request path is the directory, keys of uploads are relative to root
+	dirKey := multipartKey(mux.Vars(req)["path"])
+	if dirKey != "" {
+		dirKey += "/"
+	}
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	keyMarker := query.Get("key-marker")
+	uploadIdMarker := query.Get("upload-id-marker")
+	owner := multipartOwner(req)
+
+	bucket, _ := splitBucketKey(dirKey)
+	result := ListMultipartUploadsResult{
+		Bucket:         bucket,
+		KeyMarker:      keyMarker,
+		UploadIdMarker: uploadIdMarker,
+		Prefix:         prefix,
+		Delimiter:      delimiter,
+		MaxUploads:     maxUploads,
+		Uploads:        make([]S3Upload, 0),
+	}
+	seenPrefixes := make(map[string]bool)
+	auths := make(map[string]bool)
+	for _, u := range s.multipartUploads().List() {
+		if u.Owner != "" && u.Owner != owner {
+			continue
+		}
+		if !strings.HasPrefix(u.Key, dirKey+prefix) {
+			continue
+		}
+		// 子目录的.ghs.yml可能不允许上传
+		dir := filepath.Dir(u.Key)
+		canUpload, ok := auths[dir]
+		if !ok {
+			auth := s.readAccessConf(dir)
+			canUpload = auth.canUpload(req)
+			auths[dir] = canUpload
+		}
+		if !canUpload {
+			continue
+		}
+		key := u.Key[len(dirKey):]
+		if key < keyMarker || (key == keyMarker && (uploadIdMarker == "" || u.UploadId <= uploadIdMarker)) {
+			continue
+		}
+		if delimiter != "" {
+			if idx := strings.Index(key[len(prefix):], delimiter); idx >= 0 {
+				commonPrefix := key[:len(prefix)+idx+len(delimiter)]
+				if !seenPrefixes[commonPrefix] {
+					seenPrefixes[commonPrefix] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, S3CommonPrefix{commonPrefix})
+				}
+				continue
+			}
+		}
+		if len(result.Uploads) >= maxUploads {
+			result.IsTruncated = true
+			break
+		}
+		result.Uploads = append(result.Uploads, S3Upload{
+			Key:          key,
+			UploadId:     u.UploadId,
+			Initiator:    multipartOwnerXML(u.Owner),
+			Owner:        multipartOwnerXML(u.Owner),
+			StorageClass: "STANDARD",
+			Initiated:    u.Initiated.UTC().Format(s3TimeFormat),
+		})
+		result.NextKeyMarker = key
+		result.NextUploadIdMarker = u.UploadId
+	}
+	writeS3XML(w, http.StatusOK, result)
+}
+
+func (s *HTTPStaticServer) reapMultipartUploads() {
+	if s.MultipartExpire <= 0 {
+		return
+	}
+	count, reclaimed := s.multipartUploads().Reap(time.Now().Add(-s.MultipartExpire))
+	if count > 0 {
+		log.Printf("Reaped %d abandoned multipart uploads, reclaimed %d bytes", count, reclaimed)
+	}
+}
+
 func (s *HTTPStaticServer) hUploadOrMkdir(w http.ResponseWriter, req *http.Request) {
 	requestMethod := strings.ToUpper(req.Method)
 	path := mux.Vars(req)["path"]
@@ -449,6 +893,10 @@ func (s *HTTPStaticServer) hUploadOrMkdir(w http.ResponseWriter, req *http.Reque
 		http.Error(w, "Invalid parent directory accessing.", http.StatusBadRequest)
 		return
 	}
+	if isTrashPath(path) {
+		http.Error(w, "Name is reserved by gohttpserver", http.StatusForbidden)
+		return
+	}
 
 	filename := filepath.Base(path)  			// 文件名，会自动忽略掉结尾的"/"
 	dirname := filepath.Dir(path)    			// request path中的的directory name
@@ -466,6 +914,18 @@ func (s *HTTPStaticServer) hUploadOrMkdir(w http.ResponseWriter, req *http.Reque
 			s.hUnzip(w, req)
 			return
 		}
+		if op == "restore" {
+			s.hVersionRestore(w, req)
+			return
+		}
+		if op == "move" {
+			s.hMoveOp(w, req)
+			return
+		}
+		if op == "copy" {
+			s.hCopyOp(w, req)
+			return
+		}
 	}
 
 	// s3 multipart uploads handlers
@@ -479,14 +939,26 @@ func (s *HTTPStaticServer) hUploadOrMkdir(w http.ResponseWriter, req *http.Reque
 			s.hS3CompleteMultipartUploads(w, req, uploadId)
 			return
 		}
+		if _, exists := query["delete"]; exists && s.isS3Request(req) {
+			s.hS3DeleteObjects(w, req)
+			return
+		}
 	}
 	if requestMethod == "PUT" {
+		if query.Get("op") == "edit" {
+			s.hEditSave(w, req)
+			return
+		}
 		partNumber := query.Get("partNumber")
 		uploadId := query.Get("uploadId")
 		if partNumber != "" && uploadId != "" {
 			s.hS3UploadPart(w, req, partNumber, uploadId)
 			return
 		}
+		if s.isS3Request(req) {
+			s.hS3Put(w, req)
+			return
+		}
 	}
 
 	// check auth (ghs standalone auth, unused for oauth2-proxy mode)
@@ -503,41 +975,57 @@ func (s *HTTPStaticServer) hUploadOrMkdir(w http.ResponseWriter, req *http.Reque
 			http.Error(w, err.Error(), http.StatusForbidden)
 			return
 		}
+		// 多级路径上传时中间目录也会被创建，每一级都要检查
+		if err := checkRelativePath(multipartKey(path)); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
 	}
 
 	dstPath := filepath.Join(dirpath, filename)	// 最终存在文件系统里的文件完整路径
 
-	// POST为非覆盖写
-	if requestMethod == "POST" && IsExists(dstPath) {
-		w.Header().Set("Content-Type", "application/json;charset=utf-8")
-		w.Header().Set("Connection", "close")
-		w.WriteHeader(http.StatusConflict)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success":     false,
-			"description": "file already exists.",
-			"code":			http.StatusConflict,
-		})
+	// 文件已存在时的处理: reject, overwrite, rename, version
+	// 默认POST为非覆盖写，PUT为覆盖写，.ghs.yml里可以改默认值
+	conflict := query.Get("conflict")
+	if err := checkConflict(conflict); err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	// 目标是文件夹的可能是文件夹上传，解析完form再说
+	if uploadConflict(req, conflict, auth) == conflictReject && isFile(dstPath) {
+		writeUploadError(w, errFileExists)
 		return
 	}
 
 	// read file body
 	var file io.Reader = nil
+	var contentType string
+	var fileSize int64 = -1
 	contentLength := req.Header.Get("Content-Length")
 	if contentLength != "0" && contentLength != "" {
 		if !strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/form-data") {
 			// file的二进制内容都在body部分
 			file = req.Body
+			contentType = req.Header.Get("Content-Type")
+			fileSize = req.ContentLength
 		} else {
 			// 兼容旧的multipart/form-data的形式
 			// 推迟到要读取body的multipar form了才开始解析，并给2G缓冲区
 			req.ParseMultipartForm(2 << 30)
+			if req.MultipartForm != nil {
+				defer req.MultipartForm.RemoveAll() // Seen from go source code, req.MultipartForm not nil after call FormFile(..)
+			}
+			// 带了relativePath的是文件夹上传，request path是目标文件夹
+			if isFolderUpload(req) {
+				s.hUploadFolder(w, req, path)
+				return
+			}
 
-			mpFile, _, _ := req.FormFile("file")
+			mpFile, mpHeader, _ := req.FormFile("file")
 			if mpFile != nil {
 				defer mpFile.Close()
-			}
-			if req.MultipartForm != nil {
-				defer req.MultipartForm.RemoveAll() // Seen from go source code, req.MultipartForm not nil after call FormFile(..)
+				contentType = mpHeader.Header.Get("Content-Type")
+				fileSize = mpHeader.Size
 			}
 
 			file = mpFile
@@ -579,21 +1067,26 @@ func (s *HTTPStaticServer) hUploadOrMkdir(w http.ResponseWriter, req *http.Reque
 		return
 	}
 
-	// 3. write file to disk
-	dst, err := os.Create(dstPath)
+	digests, err := parseUploadDigests(req, file == req.Body)
 	if err != nil {
-		log.Println("Create file:", err)
-		w.Header().Set("Connection", "close")
-		http.Error(w, "File create " + err.Error(), http.StatusConflict)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer dst.Close()
-	if _, err := io.Copy(dst, file); err != nil {
-		log.Println("Handle upload file:", err)
-		w.Header().Set("Connection", "close")
-		http.Error(w, err.Error(), http.StatusConflict)
+
+	// 3. write file to disk
+	result, err := s.saveUpload(req, &uploadFile{
+		Path:        filepath.Join(dirname, filename),
+		Body:        file,
+		Size:        fileSize,
+		ContentType: contentType,
+		Digests:     digests,
+		Conflict:    conflict,
+	})
+	if err != nil {
+		writeUploadError(w, err)
 		return
 	}
+	w.Header().Set("Repr-Digest", result.reprDigest)
 
 	// response empty body for s3 user agent
 	isS3UserAgent, _ := regexp.MatchString("(Boto|aws-sdk-go|S3Manager)", req.Header.Get("User-Agent"))
@@ -602,10 +1095,16 @@ func (s *HTTPStaticServer) hUploadOrMkdir(w http.ResponseWriter, req *http.Reque
 	}
 
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	response := map[string]interface{}{
 		"success":     true,
-		"destination": path,
-	})
+		"destination": result.Path, // 重命名的话和request path不一样
+		"md5":         result.MD5,
+		"sha256":      result.SHA256,
+	}
+	if result.Version != "" {
+		response["version"] = result.Version
+	}
+	json.NewEncoder(w).Encode(response)
 }
 
 type FileJSONInfo struct {
@@ -615,6 +1114,10 @@ type FileJSONInfo struct {
 	Path    string      `json:"path"`
 	ModTime int64       `json:"mtime"`
 	Extra   interface{} `json:"extra,omitempty"`
+
+	ContentType string            `json:"contentType,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Uploader    string            `json:"uploader,omitempty"`
 }
 
 // path should be absolute
@@ -668,6 +1171,11 @@ func (s *HTTPStaticServer) hInfo(w http.ResponseWriter, r *http.Request) {
 	default:
 		fji.Type = "text"
 	}
+	if meta := getFileMeta(relPath, fi); meta != nil {
+		fji.ContentType = meta.ContentType
+		fji.Metadata = meta.Metadata
+		fji.Uploader = meta.Uploader
+	}
 	data, _ := json.Marshal(fji)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(data)
@@ -691,13 +1199,15 @@ func (s *HTTPStaticServer) hZip(w http.ResponseWriter, r *http.Request) {
 func (s *HTTPStaticServer) hUnzip(w http.ResponseWriter, req *http.Request) {
 
 	path := mux.Vars(req)["path"]
-	filename := filepath.Base(path)  			// 文件名，会自动忽略掉结尾的"/"
-	dirname := filepath.Dir(path)    			// request path中的的directory name
-	dirpath := filepath.Join(s.Root, dirname) 	// 实际存储系统中的存储目录
-	dstPath := filepath.Join(dirpath, filename)	// 最终存在文件系统里的文件完整路径
-
-	// sig: unzipFile(src, dst)
-	err := unzipFile(dstPath, dirpath)
+	err := s.unzip(req, path)
+	switch e := err.(type) {
+	case *S3APIError:
+		http.Error(w, e.Message, e.Status)
+		return
+	case *quotaError:
+		writeUploadError(w, e)
+		return
+	}
 	message := "success"
 	if err != nil {
 		message = err.Error()
@@ -712,6 +1222,46 @@ func (s *HTTPStaticServer) hUnzip(w http.ResponseWriter, req *http.Request) {
 	return
 }
 
+// unzip extracts the zip file at path into its directory
+func (s *HTTPStaticServer) unzip(req *http.Request, path string) error {
+	filename := filepath.Base(path)  			// 文件名，会自动忽略掉结尾的"/"
+	dirname := filepath.Dir(path)    			// request path中的的directory name
+	dirpath := filepath.Join(s.Root, dirname) 	// 实际存储系统中的存储目录
+	dstPath := filepath.Join(dirpath, filename)	// 最终存在文件系统里的文件完整路径
+
+	auth := s.readAccessConf(path)
+	if !auth.canUpload(req) {
+		return &S3APIError{http.StatusForbidden, "AccessDenied", "Upload forbidden"}
+	}
+	// 解压出来的每个文件和上传一样按所在目录的.ghs.yml检查，有一个不行就什么都不写
+	accessConfs := make(map[string]AccessConf)
+	checkEntry := func(name string, f *zip.File) error {
+		dir := filepath.ToSlash(filepath.Join(dirname, filepath.Dir(name)))
+		entryAuth, ok := accessConfs[dir]
+		if !ok {
+			entryAuth = s.readAccessConf(filepath.Join(dir, filepath.Base(name)))
+			accessConfs[dir] = entryAuth
+		}
+		return entryAuth.checkZipEntry(filepath.Base(name), f)
+	}
+	// 解压前按解压后的总大小检查quota，打不开的zip留给unzipFile报错
+	size, files, err := unzipUsage(dstPath, checkEntry)
+	if _, ok := err.(*S3APIError); ok {
+		return err
+	}
+	if err := s.checkQuota(auth, size, files); err != nil {
+		return err
+	}
+
+	// sig: unzipFile(src, dst)
+	if err := unzipFile(dstPath, dirpath); err != nil {
+		// 解压了一半的文件等下次重建索引时再算进quota
+		return err
+	}
+	s.addQuotaUsage(auth, size, files)
+	return nil
+}
+
 func combineURL(r *http.Request, path string) *url.URL {
 	return &url.URL{
 		Scheme: r.URL.Scheme,
@@ -845,6 +1395,9 @@ type UserControl struct {
 	Upload bool
 	Delete bool
 	Token  string
+	// s3 access key pair, requests signed with it act as this user
+	AccessKey string `yaml:"accessKey" json:"-"`
+	SecretKey string `yaml:"secretKey" json:"-"`
 }
 
 type AccessConf struct {
@@ -853,6 +1406,18 @@ type AccessConf struct {
 	Archive      bool		   `yaml:"archive" json:"archive"`
 	Users        []UserControl `yaml:"users" json:"users"`
 	AccessTables []AccessTable `yaml:"accessTables"`
+	Conflict     string        `yaml:"conflict" json:"conflict,omitempty"` // default conflict policy of uploads, see upload.go
+
+	// upload policy, see policy.go
+	MaxFileSize       ByteSize `yaml:"maxFileSize" json:"maxFileSize,omitempty"`
+	AllowedExtensions []string `yaml:"allowedExtensions" json:"allowedExtensions,omitempty"`
+	DeniedExtensions  []string `yaml:"deniedExtensions" json:"deniedExtensions,omitempty"`
+	AllowedMimeTypes  []string `yaml:"allowedMimeTypes" json:"allowedMimeTypes,omitempty"`
+
+	Quota  *Quota   `yaml:"quota" json:"quota,omitempty"`
+	quotas []*Quota // quotas of this and all parent directories, see quota.go
+
+	Versioning Versioning `yaml:"versioning" json:"versioning"` // see versions.go
 }
 
 var reCache = make(map[string]*regexp.Regexp)
@@ -876,15 +1441,10 @@ func (c *AccessConf) canAccess(fileName string) bool {
 }
 
 func (c *AccessConf) canDelete(r *http.Request) bool {
-	session, err := store.Get(r, defaultSessionName)
-	if err != nil {
-		return c.Delete
-	}
-	val := session.Values["user"]
-	if val == nil {
+	userInfo := currentUser(r)
+	if userInfo == nil {
 		return c.Delete
 	}
-	userInfo := val.(*UserInfo)
 	for _, rule := range c.Users {
 		if rule.Email == userInfo.Email {
 			return rule.Delete
@@ -907,20 +1467,17 @@ func (c *AccessConf) canUploadByToken(token string) bool {
 }
 
 func (c *AccessConf) canUpload(r *http.Request) bool {
+	if grant, ok := r.Context().Value(presignGrantKey{}).(*presignGrant); ok {
+		return grant.canUpload(r)
+	}
 	token := r.FormValue("token")
 	if token != "" {
 		return c.canUploadByToken(token)
 	}
-	session, err := store.Get(r, defaultSessionName)
-	if err != nil {
+	userInfo := currentUser(r)
+	if userInfo == nil {
 		return c.Upload
 	}
-	val := session.Values["user"]
-	if val == nil {
-		return c.Upload
-	}
-	userInfo := val.(*UserInfo)
-
 	for _, rule := range c.Users {
 		if rule.Email == userInfo.Email {
 			return rule.Upload
@@ -969,7 +1526,7 @@ func (s *HTTPStaticServer) hJSONList(w http.ResponseWriter, r *http.Request) {
 	// turn file list -> json
 	lrs := make([]HTTPFileInfo, 0)
 	for path, info := range fileInfoMap {
-		if !auth.canAccess(info.Name()) {
+		if !auth.canAccess(info.Name()) || isInternalFile(info.Name()) {
 			continue
 		}
 		lr := HTTPFileInfo{
@@ -1005,37 +1562,71 @@ func (s *HTTPStaticServer) hJSONList(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
-var dirSizeMap = make(map[string]int64)
+var (
+	dirSizeMap  = make(map[string]int64)
+	dirFilesMap = make(map[string]int64)
+	dirSizeMu   sync.Mutex
+)
 
-func (s *HTTPStaticServer) makeIndex() error {
-	var indexes = make([]IndexFileItem, 0)
-	var err = filepath.Walk(s.Root, func(path string, info os.FileInfo, err error) error {
+// walkTree walks dir recursively, fn gets every file and directory with path relative to root in slash form.
+// Temp files and meta databases are skipped, fn can return filepath.SkipDir to skip a directory.
+func (s *HTTPStaticServer) walkTree(dir string, fn func(path string, info os.FileInfo) error) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			log.Printf("WARN: Visit path: %s error: %v", strconv.Quote(path), err)
 			return filepath.SkipDir
 			// return err
 		}
-		if info.IsDir() {
+		if isInternalFile(info.Name()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 
 		path, _ = filepath.Rel(s.Root, path)
-		path = filepath.ToSlash(path)
-		indexes = append(indexes, IndexFileItem{path, info})
+		return fn(filepath.ToSlash(path), info)
+	})
+}
+
+func (s *HTTPStaticServer) makeIndex() error {
+	var indexes = make([]IndexFileItem, 0)
+	var dirs = make([]string, 0)
+	var err = s.walkTree(s.Root, func(path string, info os.FileInfo) error {
+		if !info.IsDir() {
+			indexes = append(indexes, IndexFileItem{path, info})
+		} else {
+			dirs = append(dirs, path)
+		}
 		return nil
 	})
+	s.pruneVersions(dirs)
+	stored := s.storedUsages(dirs)
+	dirSizeMu.Lock()
 	s.indexes = indexes
+	s.stored = stored
 	dirSizeMap = make(map[string]int64)
+	dirFilesMap = make(map[string]int64)
+	s.quotaUsage.reset()
+	dirSizeMu.Unlock()
 	return err
 }
 
+// inDir reports whether path is under dir, both are relative to root in slash form
+func inDir(path, dir string) bool {
+	dir = strings.Trim(dir, "/")
+	return dir == "" || dir == "." || strings.HasPrefix(path, dir+"/")
+}
+
 func (s *HTTPStaticServer) historyDirSize(dir string) int64 {
+	dirSizeMu.Lock()
+	defer dirSizeMu.Unlock()
 	var size int64
 	if size, ok := dirSizeMap[dir]; ok {
 		return size
 	}
 	for _, fitem := range s.indexes {
-		if filepath.HasPrefix(fitem.Path, dir) {
+		if inDir(fitem.Path, dir) {
 			size += fitem.Info.Size()
 		}
 	}
@@ -1043,6 +1634,22 @@ func (s *HTTPStaticServer) historyDirSize(dir string) int64 {
 	return size
 }
 
+func (s *HTTPStaticServer) historyDirFiles(dir string) int64 {
+	dirSizeMu.Lock()
+	defer dirSizeMu.Unlock()
+	if files, ok := dirFilesMap[dir]; ok {
+		return files
+	}
+	var files int64
+	for _, fitem := range s.indexes {
+		if inDir(fitem.Path, dir) {
+			files++
+		}
+	}
+	dirFilesMap[dir] = files
+	return files
+}
+
 func (s *HTTPStaticServer) findIndex(text string) []IndexFileItem {
 	ret := make([]IndexFileItem, 0)
 	for _, item := range s.indexes {
@@ -1102,10 +1709,18 @@ func (s *HTTPStaticServer) readAccessConf(requestPath string) (ac AccessConf) {
 		}
 		log.Printf("Err read .ghs.yml: %v", err)
 	}
+	// quota只对设置它的目录生效，子目录继承的是父目录的quota本身
+	parentQuota := ac.Quota
+	ac.Quota = nil
 	err = yaml.Unmarshal(data, &ac)
 	if err != nil {
 		log.Printf("Err format .ghs.yml: %v", err)
 	}
+	if ac.Quota != nil {
+		ac.setQuotaDir(s.Root, relPath)
+	} else {
+		ac.Quota = parentQuota
+	}
 	return
 }
 
@@ -1205,6 +1820,9 @@ func checkFilename(name string) error {
 	if strings.ContainsAny(name, "\\/") {
 		return errors.New("Name should not be empty or contains \\/")
 	}
+	if isInternalFile(name) {
+		return errors.New("Name is reserved by gohttpserver")
+	}
 	return nil
 }
 
@@ -1225,7 +1843,7 @@ func IsSafePath(path string) bool {
 	}
 
 	// 任意包含访问parent 目录的path都不安全，ban掉
-	if strings.HasPrefix("../", path) {
+	if path == ".." || strings.HasPrefix(path, "../") {
 		return false
 	}
 	matched, _ := regexp.MatchString(`[\/\\]\.{1,2}[\/\\]`, path)
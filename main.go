@@ -14,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/alecthomas/kingpin"
 	accesslog "github.com/codeskyblue/go-accesslog"
@@ -24,23 +25,30 @@ import (
 )
 
 type Configure struct {
-	Conf            *os.File `yaml:"-"`
-	Addr            string   `yaml:"addr"`
-	Port            int      `yaml:"port"`
-	Root            string   `yaml:"root"`
-	HTTPAuth        string   `yaml:"httpauth"`
-	Cert            string   `yaml:"cert"`
-	Key             string   `yaml:"key"`
-	Cors            bool     `yaml:"cors"`
-	Theme           string   `yaml:"theme"`
-	XHeaders        bool     `yaml:"xheaders"`
-	Upload          bool     `yaml:"upload"`
-	Delete          bool     `yaml:"delete"`
-	PlistProxy      string   `yaml:"plistproxy"`
-	Title           string   `yaml:"title"`
-	Debug           bool     `yaml:"debug"`
-	GoogleTrackerID string   `yaml:"google-tracker-id"`
-	DisableArchive  bool     `yaml:"archive"`
+	Conf            *os.File      `yaml:"-"`
+	Addr            string        `yaml:"addr"`
+	Port            int           `yaml:"port"`
+	Root            string        `yaml:"root"`
+	HTTPAuth        string        `yaml:"httpauth"`
+	Cert            string        `yaml:"cert"`
+	Key             string        `yaml:"key"`
+	Cors            bool          `yaml:"cors"`
+	Theme           string        `yaml:"theme"`
+	XHeaders        bool          `yaml:"xheaders"`
+	Upload          bool          `yaml:"upload"`
+	Delete          bool          `yaml:"delete"`
+	PlistProxy      string        `yaml:"plistproxy"`
+	Title           string        `yaml:"title"`
+	Debug           bool          `yaml:"debug"`
+	GoogleTrackerID string        `yaml:"google-tracker-id"`
+	DisableArchive  bool          `yaml:"archive"`
+	MultipartExpire time.Duration `yaml:"multipart-expire"`
+	Trash           bool          `yaml:"trash"`
+	TrashExpire     time.Duration `yaml:"trash-expire"`
+	StagingDir      string        `yaml:"staging-dir"`
+	MinPartSize     ByteSize      `yaml:"multipart-min-part-size"`
+	MaxPartSize     ByteSize      `yaml:"multipart-max-part-size"`
+	MaxPartCount    int           `yaml:"multipart-max-parts"`
 	Auth            struct {
 		Type   string `yaml:"type"` // openid|http|github
 		OpenID string `yaml:"openid"`
@@ -48,6 +56,15 @@ type Configure struct {
 		ID     string `yaml:"id"`     // for oauth2
 		Secret string `yaml:"secret"` // for oauth2
 	} `yaml:"auth"`
+	S3 struct {
+		Enable bool   `yaml:"enable"`
+		Domain string `yaml:"domain"` // for virtual-host style, eg: s3.example.com
+		Region string `yaml:"region"`
+		// access keys for aws signature v4, more can be added to users of .ghs.yml
+		Credentials []S3Credential `yaml:"credentials"`
+		// secret of urls generated by /-/presign, share it between instances behind a load balancer
+		PresignSecret string `yaml:"presign-secret"`
+	} `yaml:"s3"`
 }
 
 type httpLogger struct{}
@@ -98,6 +115,13 @@ func parseFlags() error {
 	gcfg.Auth.OpenID = defaultOpenID
 	gcfg.GoogleTrackerID = "UA-81205425-2"
 	gcfg.Title = "Go HTTP File Server"
+	gcfg.MultipartExpire = 24 * time.Hour
+	gcfg.TrashExpire = 30 * 24 * time.Hour
+	gcfg.StagingDir = os.TempDir()
+	gcfg.MinPartSize = 5 << 20
+	gcfg.MaxPartSize = 5 << 30
+	gcfg.MaxPartCount = 10000
+	gcfg.S3.Region = "us-east-1"
 
 	kingpin.HelpFlag.Short('h')
 	kingpin.Version(versionMessage())
@@ -120,6 +144,17 @@ func parseFlags() error {
 	kingpin.Flag("plistproxy", "plist proxy when server is not https").Short('p').StringVar(&gcfg.PlistProxy)
 	kingpin.Flag("title", "server title").StringVar(&gcfg.Title)
 	kingpin.Flag("google-tracker-id", "set to empty to disable it").StringVar(&gcfg.GoogleTrackerID)
+	kingpin.Flag("multipart-expire", "remove multipart uploads without activity for this long, 0 to disable").DurationVar(&gcfg.MultipartExpire)
+	kingpin.Flag("trash", "move deleted files to .ghs-trash instead of removing them").BoolVar(&gcfg.Trash)
+	kingpin.Flag("trash-expire", "purge deleted files after this long, 0 to keep them forever").DurationVar(&gcfg.TrashExpire)
+	kingpin.Flag("staging-dir", "directory to keep unfinished uploads, default is system temp dir").StringVar(&gcfg.StagingDir)
+	kingpin.Flag("multipart-min-part-size", "min size of multipart upload parts except the last one, eg: 5MB").SetValue(&gcfg.MinPartSize)
+	kingpin.Flag("multipart-max-part-size", "max size of multipart upload parts, eg: 5GB").SetValue(&gcfg.MaxPartSize)
+	kingpin.Flag("multipart-max-parts", "max part count of multipart uploads").IntVar(&gcfg.MaxPartCount)
+	kingpin.Flag("s3", "enable s3 compatible api for s3 clients").BoolVar(&gcfg.S3.Enable)
+	kingpin.Flag("s3-domain", "domain for virtual-host style buckets, eg: s3.example.com").StringVar(&gcfg.S3.Domain)
+	kingpin.Flag("s3-region", "region of s3 api, default us-east-1").StringVar(&gcfg.S3.Region)
+	kingpin.Flag("s3-presign-secret", "secret to sign urls generated by /-/presign, random if not set").StringVar(&gcfg.S3.PresignSecret)
 
 	kingpin.Parse() // first parse conf
 
@@ -154,6 +189,20 @@ func main() {
 	ss.Delete = gcfg.Delete
 	ss.Archive = !gcfg.DisableArchive
 	ss.AuthType = gcfg.Auth.Type
+	ss.MultipartExpire = gcfg.MultipartExpire
+	ss.Trash = gcfg.Trash
+	ss.TrashExpire = gcfg.TrashExpire
+	ss.StagingDir = gcfg.StagingDir
+	ss.MinPartSize = int64(gcfg.MinPartSize)
+	ss.MaxPartSize = int64(gcfg.MaxPartSize)
+	ss.MaxPartCount = gcfg.MaxPartCount
+	ss.S3 = gcfg.S3.Enable
+	ss.S3Domain = gcfg.S3.Domain
+	ss.S3Region = gcfg.S3.Region
+	ss.S3Credentials = gcfg.S3.Credentials
+	if gcfg.S3.PresignSecret != "" {
+		ss.S3PresignSecret = gcfg.S3.PresignSecret
+	}
 
 	if gcfg.PlistProxy != "" {
 		u, err := url.Parse(gcfg.PlistProxy)
@@ -166,7 +215,7 @@ func main() {
 	if ss.PlistProxy != "" {
 		log.Printf("plistproxy: %s", strconv.Quote(ss.PlistProxy))
 	}
-	
+
 	var hdlr http.Handler = ss
 
 	hdlr = accesslog.NewLoggingHandler(hdlr, logger)
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// metaFileName is the hidden database in every directory keeping metadata of the files in it
+const metaFileName = ".ghs-meta.json"
+
+// s3 limits user metadata to 2KB
+const maxUserMetadataSize = 2 << 10
+
+var errMetadataTooLarge = errors.New("Your metadata headers exceed the maximum allowed metadata size.")
+
+// FileMeta is what the uploader tells about a file besides its content
+type FileMeta struct {
+	ContentType string            `json:"contentType,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"` // x-amz-meta-* headers, keys are lower case without the prefix
+	Uploader    string            `json:"uploader,omitempty"` // email of the uploader, empty for anonymous
+
+	// size and mtime of the file when meta is saved, meta of files changed outside gohttpserver is dropped
+	Size    int64 `json:"size"`
+	ModTime int64 `json:"mtime"`
+}
+
+func (m *FileMeta) empty() bool {
+	return m.ContentType == "" && len(m.Metadata) == 0 && m.Uploader == ""
+}
+
+// isInternalFile reports whether name is a file managed by gohttpserver itself, which is never listed
+func isInternalFile(name string) bool {
+	base := filepath.Base(name)
+	return isTempFile(name) || base == metaFileName || base == versionsDirName || base == trashDirName
+}
+
+// fileMetaFromRequest collects Content-Type and x-amz-meta-* headers of an upload request
+func fileMetaFromRequest(req *http.Request, contentType string) (*FileMeta, error) {
+	meta := &FileMeta{}
+	// curl --data-binary sends it by default, it is not the type of the file
+	if contentType != "application/x-www-form-urlencoded" {
+		meta.ContentType = contentType
+	}
+	size := 0
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if !strings.HasPrefix(name, "x-amz-meta-") || len(values) == 0 {
+			continue
+		}
+		if meta.Metadata == nil {
+			meta.Metadata = make(map[string]string)
+		}
+		key := strings.TrimPrefix(name, "x-amz-meta-")
+		meta.Metadata[key] = strings.Join(values, ",")
+		size += len(key) + len(meta.Metadata[key])
+	}
+	if size > maxUserMetadataSize {
+		return nil, errMetadataTooLarge
+	}
+	if user := currentUser(req); user != nil {
+		meta.Uploader = user.Email
+	}
+	return meta, nil
+}
+
+// setHeaders writes meta into response headers of GET/HEAD
+func (m *FileMeta) setHeaders(header http.Header) {
+	if m.ContentType != "" {
+		header.Set("Content-Type", m.ContentType)
+	}
+	for key, value := range m.Metadata {
+		header.Set("X-Amz-Meta-"+key, value)
+	}
+	if m.Uploader != "" {
+		header.Set("X-Ghs-Uploader", m.Uploader)
+	}
+}
+
+// metaLocks serializes updates of the same meta file
+var metaLocks keyedMutex
+
+func readDirMeta(dir string) map[string]*FileMeta {
+	metas := make(map[string]*FileMeta)
+	data, err := ioutil.ReadFile(filepath.Join(dir, metaFileName))
+	if err != nil {
+		return metas
+	}
+	if err := json.Unmarshal(data, &metas); err != nil {
+		log.Printf("WARN: bad %s in %s: %v", metaFileName, dir, err)
+	}
+	return metas
+}
+
+func writeDirMeta(dir string, metas map[string]*FileMeta) error {
+	metaPath := filepath.Join(dir, metaFileName)
+	if len(metas) == 0 {
+		err := os.Remove(metaPath)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+	data, err := json.MarshalIndent(metas, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := CreatePendingFile(metaPath)
+	if err != nil {
+		return err
+	}
+	defer f.Abort()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	return f.Commit()
+}
+
+func updateDirMeta(dir string, fn func(metas map[string]*FileMeta)) error {
+	unlock := metaLocks.Lock(dir)
+	defer unlock()
+	metas := readDirMeta(dir)
+	fn(metas)
+	return writeDirMeta(dir, metas)
+}
+
+// setFileMeta saves meta of the file at path, which should have been written already
+func setFileMeta(path string, meta *FileMeta) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	err = updateDirMeta(filepath.Dir(path), func(metas map[string]*FileMeta) {
+		if meta == nil || meta.empty() {
+			delete(metas, info.Name())
+			return
+		}
+		m := *meta
+		m.Size = info.Size()
+		m.ModTime = info.ModTime().UnixNano()
+		metas[info.Name()] = &m
+	})
+	if err != nil {
+		log.Printf("WARN: save meta of %s: %v", path, err)
+	}
+}
+
+// getFileMeta returns meta of the file, nil if there is none or the file has been changed since
+func getFileMeta(path string, info os.FileInfo) *FileMeta {
+	meta := readDirMeta(filepath.Dir(path))[info.Name()]
+	if meta == nil || meta.Size != info.Size() || meta.ModTime != info.ModTime().UnixNano() {
+		return nil
+	}
+	return meta
+}
+
+func removeFileMeta(path string) {
+	dir, name := filepath.Split(path)
+	if _, err := os.Stat(filepath.Join(dir, metaFileName)); err != nil {
+		return
+	}
+	err := updateDirMeta(filepath.Clean(dir), func(metas map[string]*FileMeta) {
+		delete(metas, name)
+	})
+	if err != nil {
+		log.Printf("WARN: remove meta of %s: %v", path, err)
+	}
+}
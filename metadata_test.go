@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileMetaFromRequest(t *testing.T) {
+	req := newTestRequest("PUT", "/a.txt", nil)
+	req.Header.Set("X-Amz-Meta-Author", "alice")
+	req.Header.Set("X-Amz-Meta-Tag", "x")
+	meta, err := fileMetaFromRequest(req, "text/plain")
+	assert.NoError(t, err)
+	assert.Equal(t, "text/plain", meta.ContentType)
+	assert.Equal(t, map[string]string{"author": "alice", "tag": "x"}, meta.Metadata)
+
+	meta, err = fileMetaFromRequest(req, "application/x-www-form-urlencoded")
+	assert.NoError(t, err)
+	assert.Equal(t, "", meta.ContentType)
+
+	req.Header.Set("X-Amz-Meta-Big", strings.Repeat("a", maxUserMetadataSize))
+	_, err = fileMetaFromRequest(req, "")
+	assert.Equal(t, errMetadataTooLarge, err)
+}
+
+func TestFileMetaDroppedWhenChanged(t *testing.T) {
+	s := newTestServer(t, map[string]string{"dir/a.txt": "hello"})
+	path := filepath.Join(s.Root, "dir/a.txt")
+	setFileMeta(path, &FileMeta{ContentType: "text/markdown", Metadata: map[string]string{"author": "alice"}})
+	assert.True(t, testFileExists(s, "dir/"+metaFileName))
+
+	meta := getFileMeta(path, statTestFile(t, path))
+	if assert.NotNil(t, meta) {
+		assert.Equal(t, "alice", meta.Metadata["author"])
+	}
+
+	// changed outside gohttpserver
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, ioutil.WriteFile(path, []byte("hello world"), 0644))
+	assert.Nil(t, getFileMeta(path, statTestFile(t, path)))
+
+	setFileMeta(path, &FileMeta{ContentType: "text/plain"})
+	removeFileMeta(path)
+	assert.Nil(t, getFileMeta(path, statTestFile(t, path)))
+	// the meta file is removed with its last entry
+	assert.False(t, testFileExists(s, "dir/"+metaFileName))
+}
+
+func TestS3ObjectMetadata(t *testing.T) {
+	s := newTestServer(t, map[string]string{"bkt/": ""})
+	s.S3 = true
+
+	req := newS3Request("PUT", "/bkt/a.md", strings.NewReader("# hello"))
+	req.Header.Set("Content-Type", "text/markdown")
+	req.Header.Set("X-Amz-Meta-Author", "alice")
+	assert.Equal(t, http.StatusOK, serveTest(s.hUploadOrMkdir, req).Code)
+
+	w := serveTest(s.hIndex, newS3Request("HEAD", "/bkt/a.md", nil))
+	assert.Equal(t, "text/markdown", w.Header().Get("Content-Type"))
+	assert.Equal(t, "alice", w.Header().Get("X-Amz-Meta-Author"))
+
+	// COPY keeps metadata of the source, REPLACE takes it from the request
+	req = newS3Request("PUT", "/bkt/b.md", nil)
+	req.Header.Set("X-Amz-Copy-Source", "/bkt/a.md")
+	assert.Equal(t, http.StatusOK, serveTest(s.hUploadOrMkdir, req).Code)
+	w = serveTest(s.hIndex, newS3Request("HEAD", "/bkt/b.md", nil))
+	assert.Equal(t, "alice", w.Header().Get("X-Amz-Meta-Author"))
+
+	req = newS3Request("PUT", "/bkt/b.md", nil)
+	req.Header.Set("X-Amz-Copy-Source", "/bkt/a.md")
+	req.Header.Set("X-Amz-Metadata-Directive", "REPLACE")
+	req.Header.Set("X-Amz-Meta-Author", "bob")
+	assert.Equal(t, http.StatusOK, serveTest(s.hUploadOrMkdir, req).Code)
+	w = serveTest(s.hIndex, newS3Request("HEAD", "/bkt/b.md", nil))
+	assert.Equal(t, "bob", w.Header().Get("X-Amz-Meta-Author"))
+
+	// the meta file itself is neither listed nor readable
+	w = serveTest(s.hIndex, newS3Request("GET", "/bkt", nil))
+	assert.NotContains(t, w.Body.String(), metaFileName)
+	w = serveTest(s.hIndex, newS3Request("GET", "/bkt/"+metaFileName, nil))
+	assert.NotEqual(t, http.StatusOK, w.Code)
+
+	// overwriting without metadata drops it
+	req = newS3Request("PUT", "/bkt/a.md", strings.NewReader("# hello world"))
+	assert.Equal(t, http.StatusOK, serveTest(s.hUploadOrMkdir, req).Code)
+	w = serveTest(s.hIndex, newS3Request("HEAD", "/bkt/a.md", nil))
+	assert.Equal(t, "", w.Header().Get("X-Amz-Meta-Author"))
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	errDestinationExists = &S3APIError{http.StatusConflict, "FileExists", "destination already exists."}
+	errMoveNotFound      = &S3APIError{http.StatusNotFound, "NoSuchKey", "source does not exist."}
+	errMoveForbidden     = &S3APIError{http.StatusForbidden, "AccessDenied", "Move forbidden"}
+)
+
+// moveRequest is a rename or move of a file or directory, paths are relative to root in slash form
+type moveRequest struct {
+	Src       string
+	Dst       string
+	Overwrite bool // replace an existing file at Dst, directories are never replaced
+}
+
+// checkOpPath refuses internal files, .ghs.yml and invalid names in any part of the path on both sides of a move or copy
+func checkOpPath(path string) error {
+	if path == "" {
+		return &S3APIError{http.StatusForbidden, "InvalidArgument", "Unable to move bucket root."}
+	}
+	if filepath.Base(path) == YAMLCONF {
+		return &S3APIError{http.StatusForbidden, "AccessDenied", YAMLCONF + " can not be moved or copied"}
+	}
+	// 每一级都要检查，不能移进或移出.ghs-versions之类的内部目录
+	if err := checkRelativePath(path); err != nil {
+		return &S3APIError{http.StatusForbidden, "InvalidArgument", err.Error()}
+	}
+	return nil
+}
+
+// checkMoveDir checks every file in the directory to be moved, the same as checkOpPath and the upload policy of a file.
+// A .ghs.yml anywhere inside would take its permissions to the destination.
+func checkMoveDir(dir string, dstAuth AccessConf) error {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if isInternalFile(info.Name()) {
+			// 历史版本和meta跟着目录走
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Name() == YAMLCONF {
+			return &S3APIError{http.StatusForbidden, "AccessDenied", "Directories containing " + YAMLCONF + " can not be moved"}
+		}
+		if info.IsDir() {
+			return nil
+		}
+		return dstAuth.checkStoredFile(info.Name(), p)
+	})
+}
+
+// exclusiveQuotas returns ac with only the quotas which are not in other,
+// moving inside a quota does not change its usage
+func exclusiveQuotas(ac, other AccessConf) AccessConf {
+	quotas := make([]*Quota, 0, len(ac.quotas))
+	for _, q := range ac.quotas {
+		shared := false
+		for _, o := range other.quotas {
+			shared = shared || o.dir == q.dir
+		}
+		if !shared {
+			quotas = append(quotas, q)
+		}
+	}
+	ac.quotas = quotas
+	return ac
+}
+
+// move renames a file or directory, it needs delete permission of the source and upload permission of the destination.
+// Meta and previous versions of a file go with it, and the search index is updated in place.
+// It returns whether an existing file is replaced.
+func (s *HTTPStaticServer) move(req *http.Request, m moveRequest) (replaced bool, err error) {
+	src, dst := multipartKey(m.Src), multipartKey(m.Dst)
+	if err := checkOpPath(src); err != nil {
+		return false, err
+	}
+	if err := checkOpPath(dst); err != nil {
+		return false, err
+	}
+	if src == dst {
+		return false, &S3APIError{http.StatusForbidden, "InvalidArgument", "Source and destination are the same."}
+	}
+	if strings.HasPrefix(dst, src+"/") {
+		return false, &S3APIError{http.StatusConflict, "InvalidArgument", "Unable to move a directory into itself."}
+	}
+	// presigned urls only grant the signed path
+	if isPresignGrant(req) {
+		return false, errMoveForbidden
+	}
+	srcAuth := s.readAccessConf(src)
+	if !srcAuth.canDelete(req) {
+		return false, errMoveForbidden
+	}
+	dstAuth := s.readAccessConf(dst)
+	if !dstAuth.canUpload(req) {
+		return false, errMoveForbidden
+	}
+
+	// 按顺序加锁，避免两个方向相反的move互相等待
+	first, second := src, dst
+	if first > second {
+		first, second = second, first
+	}
+	unlock := s.pathLocks.Lock(first)
+	defer unlock()
+	unlock2 := s.pathLocks.Lock(second)
+	defer unlock2()
+
+	srcPath := filepath.Join(s.Root, src)
+	dstPath := filepath.Join(s.Root, dst)
+	info, err := os.Lstat(srcPath)
+	if err != nil {
+		return false, errMoveNotFound
+	}
+	if !info.IsDir() {
+		if err := dstAuth.checkStoredFile(filepath.Base(dst), srcPath); err != nil {
+			return false, err
+		}
+	} else if err := checkMoveDir(srcPath, dstAuth); err != nil {
+		return false, err
+	}
+	if dstInfo, err := os.Lstat(dstPath); err == nil {
+		if !m.Overwrite || dstInfo.IsDir() || info.IsDir() {
+			return false, errDestinationExists
+		}
+		replaced = true
+	}
+
+	size, files := pathUsage(srcPath)
+	if replaced {
+		size, files = quotaDelta(dstAuth, dstPath, size)
+	}
+	srcQuota, dstQuota := exclusiveQuotas(srcAuth, dstAuth), exclusiveQuotas(dstAuth, srcAuth)
+	if err := s.checkQuota(dstQuota, size, files); err != nil {
+		return false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(dstPath), os.ModePerm); err != nil {
+		return false, err
+	}
+	// 被覆盖的文件和上传覆盖一样，按目录设置保留历史版本
+	if replaced {
+		if _, err := s.archiveVersion(dstAuth, dstPath); err != nil {
+			return false, err
+		}
+	}
+	var meta *FileMeta
+	if !info.IsDir() {
+		meta = getFileMeta(srcPath, info)
+	}
+	if err := os.Rename(srcPath, dstPath); err != nil {
+		return false, err
+	}
+	if !info.IsDir() {
+		removeFileMeta(srcPath)
+		setFileMeta(dstPath, meta)
+		// 没有同名历史的话，历史版本跟着文件走
+		if srcVersions := fileVersionsDir(srcPath); isDir(srcVersions) && !IsExists(fileVersionsDir(dstPath)) {
+			os.MkdirAll(filepath.Dir(fileVersionsDir(dstPath)), os.ModePerm)
+			os.Rename(srcVersions, fileVersionsDir(dstPath))
+			os.Remove(filepath.Dir(srcVersions))
+		}
+	}
+	s.addQuotaUsage(srcQuota, -size, -files)
+	s.addQuotaUsage(dstQuota, size, files)
+	s.moveIndex(src, dst)
+	return replaced, nil
+}
+
+// moveIndex updates paths of the moved file or directory in the search index
+func (s *HTTPStaticServer) moveIndex(src, dst string) {
+	dirSizeMu.Lock()
+	defer dirSizeMu.Unlock()
+	indexes := make([]IndexFileItem, 0, len(s.indexes))
+	for _, item := range s.indexes {
+		if item.Path == dst {
+			continue // replaced
+		}
+		if item.Path == src || strings.HasPrefix(item.Path, src+"/") {
+			item.Path = dst + strings.TrimPrefix(item.Path, src)
+		}
+		indexes = append(indexes, item)
+	}
+	s.indexes = indexes
+	dirSizeMap = make(map[string]int64)
+	dirFilesMap = make(map[string]int64)
+}
+
+// hMoveOp handles POST /foo/a.txt?op=move&dest=/bar/b.txt, overwrite=true replaces an existing file
+func (s *HTTPStaticServer) hMoveOp(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	m := moveRequest{
+		Src:       mux.Vars(req)["path"],
+		Dst:       query.Get("dest"),
+		Overwrite: query.Get("overwrite") == "true",
+	}
+	if !IsSafePath(m.Dst) || strings.Trim(m.Dst, "/") == "" {
+		http.Error(w, "Invalid dest", http.StatusBadRequest)
+		return
+	}
+	replaced, err := s.move(req, m)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"source":      multipartKey(m.Src),
+		"destination": multipartKey(m.Dst),
+		"replaced":    replaced,
+	})
+}
+
+// hMove handles WebDAV MOVE with Destination and Overwrite headers (RFC 4918)
+func (s *HTTPStaticServer) hMove(w http.ResponseWriter, req *http.Request) {
+	path := mux.Vars(req)["path"]
+	if !IsSafePath(path) {
+		http.Error(w, "Invalid parent directory accessing.", http.StatusBadRequest)
+		return
+	}
+	dest, err := url.Parse(req.Header.Get("Destination"))
+	if err != nil || dest.Path == "" || !IsSafePath(dest.Path) {
+		http.Error(w, "Invalid Destination header", http.StatusBadRequest)
+		return
+	}
+	if dest.Host != "" && dest.Host != req.Host {
+		http.Error(w, "Destination should be on the same server", http.StatusBadGateway)
+		return
+	}
+	// Overwrite默认是T
+	overwrite := strings.ToUpper(req.Header.Get("Overwrite")) != "F"
+	replaced, err := s.move(req, moveRequest{Src: path, Dst: dest.Path, Overwrite: overwrite})
+	if err == errDestinationExists {
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+	if err != nil {
+		status, body := uploadErrorJSON(err)
+		http.Error(w, body["description"].(string), status)
+		return
+	}
+	if replaced {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckOpPath(t *testing.T) {
+	assert.NoError(t, checkOpPath("foo/bar.txt"))
+	assert.Error(t, checkOpPath(""))
+	assert.Error(t, checkOpPath("foo/.ghs.yml"))
+	assert.Error(t, checkOpPath("foo/.ghs-meta.json"))
+	assert.Error(t, checkOpPath("foo/.ghs-versions/bar.txt"))
+	assert.Error(t, checkOpPath(".ghs-trash/abc"))
+	assert.Error(t, checkOpPath("foo/"+tempFilePrefix+"x/bar.txt"))
+	assert.Error(t, checkOpPath("foo/"+metaFileName+"/bar.txt"))
+}
+
+func TestMove(t *testing.T) {
+	s := newTestServer(t, map[string]string{
+		"nightly/sub/a.txt": "hello",
+		"nightly/b.txt":     "world",
+	})
+	req := newTestRequest("MOVE", "/nightly/sub", nil)
+
+	replaced, err := s.move(req, moveRequest{Src: "nightly/sub", Dst: "/release/sub"})
+	assert.NoError(t, err)
+	assert.False(t, replaced)
+	assert.Equal(t, "hello", readTestFile(s, "release/sub/a.txt"))
+	if items := s.findIndex("a.txt"); assert.Len(t, items, 1) {
+		assert.Equal(t, "release/sub/a.txt", items[0].Path)
+	}
+
+	_, err = s.move(req, moveRequest{Src: "nightly/b.txt", Dst: "release/sub/a.txt"})
+	assert.Equal(t, errDestinationExists, err)
+	replaced, err = s.move(req, moveRequest{Src: "nightly/b.txt", Dst: "release/sub/a.txt", Overwrite: true})
+	assert.NoError(t, err)
+	assert.True(t, replaced)
+	assert.Equal(t, "world", readTestFile(s, "release/sub/a.txt"))
+	assert.Len(t, s.findIndex("txt"), 1)
+
+	_, err = s.move(req, moveRequest{Src: "release", Dst: "release/sub/x"})
+	assert.Error(t, err)
+	_, err = s.move(req, moveRequest{Src: "nightly/missing", Dst: "x"})
+	assert.Equal(t, errMoveNotFound, err)
+}
+
+func TestMoveDirChecksContent(t *testing.T) {
+	s := newTestServer(t, map[string]string{
+		"team/private/" + YAMLCONF:       "upload: false\n",
+		"team/private/deep/a.txt":        "a",
+		"team/tools/bin/run.exe":         "exe",
+		"team/docs/a.txt":                "a",
+		"team/docs/.ghs-versions/a.txt/": "",
+		"public/" + YAMLCONF:             "deniedExtensions: [.exe]\n",
+	})
+	req := newTestRequest("MOVE", "/team", nil)
+
+	_, err := s.move(req, moveRequest{Src: "team/private", Dst: "public/private"})
+	if assert.IsType(t, &S3APIError{}, err) {
+		assert.Equal(t, http.StatusForbidden, err.(*S3APIError).Status)
+	}
+	assert.True(t, testFileExists(s, "team/private/"+YAMLCONF))
+	// a parent of .ghs.yml is checked as well
+	_, err = s.move(req, moveRequest{Src: "team", Dst: "public/team"})
+	assert.Error(t, err)
+	assert.True(t, testFileExists(s, "team/private/deep/a.txt"))
+
+	_, err = s.move(req, moveRequest{Src: "team/tools", Dst: "public/tools"})
+	assert.Error(t, err)
+	assert.True(t, testFileExists(s, "team/tools/bin/run.exe"))
+
+	_, err = s.move(req, moveRequest{Src: "team/docs", Dst: "public/docs"})
+	assert.NoError(t, err)
+	assert.True(t, testFileExists(s, "public/docs/a.txt"))
+	assert.True(t, testFileExists(s, "public/docs/.ghs-versions/a.txt"))
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const multipartSessionFile = "upload.json"
+
+var (
+	errNoSuchUpload     = errors.New("The specified multipart upload does not exist.")
+	reMultipartUploadId = regexp.MustCompile(`^[0-9a-f]{32}$`)
+)
+
+type MultipartPart struct {
+	PartNumber   int       `json:"partNumber"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag"` // hex md5 of the part, without quotes
+	LastModified time.Time `json:"lastModified"`
+}
+
+// CompletePart is a part listed in the CompleteMultipartUpload request body
+type CompletePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type CompleteMultipartUpload struct {
+	XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+	Parts   []CompletePart `xml:"Part"`
+}
+
+// MultipartUpload is an upload session created by s3 InitiateMultipartUpload
+type MultipartUpload struct {
+	UploadId  string                 `json:"uploadId"`
+	Key       string                 `json:"key"`   // target path relative to root, eg: foo/bar.txt
+	Owner     string                 `json:"owner"` // email of the initiator, empty for anonymous
+	Initiated time.Time              `json:"initiated"`
+	Parts     map[int]*MultipartPart `json:"parts"`
+	Meta      FileMeta               `json:"meta"` // saved to the file when completed
+
+	dir string
+}
+
+func (u *MultipartUpload) partPath(partNumber int) string {
+	return filepath.Join(u.dir, fmt.Sprintf("part-%05d", partNumber))
+}
+
+// SortedParts returns received parts ordered by part number
+func (u *MultipartUpload) SortedParts() []*MultipartPart {
+	parts := make([]*MultipartPart, 0, len(u.Parts))
+	for _, p := range u.Parts {
+		parts = append(parts, p)
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].PartNumber < parts[j].PartNumber
+	})
+	return parts
+}
+
+// CompleteParts validates the part list sent by the client against the received parts,
+// and returns the parts to be merged in order.
+// Same as s3, part numbers must be ascending, every ETag must match,
+// and all parts except the last one must be at least minPartSize.
+func (u *MultipartUpload) CompleteParts(list []CompletePart, minPartSize int64) ([]*MultipartPart, error) {
+	if len(list) == 0 {
+		return nil, &S3APIError{http.StatusBadRequest, "MalformedXML", "You must specify at least one part."}
+	}
+	parts := make([]*MultipartPart, 0, len(list))
+	for i, cp := range list {
+		if i > 0 && cp.PartNumber <= list[i-1].PartNumber {
+			return nil, &S3APIError{http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order. The parts list must be specified in order by part number."}
+		}
+		part, ok := u.Parts[cp.PartNumber]
+		etag := strings.ToLower(strings.Trim(cp.ETag, `" `))
+		if !ok || part.ETag != etag {
+			return nil, &S3APIError{http.StatusBadRequest, "InvalidPart", fmt.Sprintf("Part %d could not be found or its ETag does not match.", cp.PartNumber)}
+		}
+		parts = append(parts, part)
+	}
+	for _, part := range parts[:len(parts)-1] {
+		if part.Size < minPartSize {
+			return nil, &S3APIError{http.StatusBadRequest, "EntityTooSmall", fmt.Sprintf("Part %d is %d bytes, smaller than the minimum allowed size %d.", part.PartNumber, part.Size, minPartSize)}
+		}
+	}
+	return parts, nil
+}
+
+// compositeETag is the ETag of a multipart uploaded object, eg: "<md5 of part md5s>-<part count>"
+func compositeETag(parts []*MultipartPart) string {
+	h := md5.New()
+	for _, part := range parts {
+		sum, _ := hex.DecodeString(part.ETag)
+		h.Write(sum)
+	}
+	return fmt.Sprintf("%x-%d", h.Sum(nil), len(parts))
+}
+
+// LastActivity returns the time of the last part uploaded, or initiated time if there is none
+func (u *MultipartUpload) LastActivity() time.Time {
+	t := u.Initiated
+	for _, part := range u.Parts {
+		if part.LastModified.After(t) {
+			t = part.LastModified
+		}
+	}
+	return t
+}
+
+func (u *MultipartUpload) clone() *MultipartUpload {
+	c := *u
+	c.Parts = make(map[int]*MultipartPart, len(u.Parts))
+	for n, p := range u.Parts {
+		part := *p
+		c.Parts[n] = &part
+	}
+	return &c
+}
+
+// MultipartRegistry keeps track of multipart upload sessions.
+// Every session owns a directory under dir, which holds the uploaded parts
+// and a json record of the session, so sessions survive server restarts.
+type MultipartRegistry struct {
+	dir     string
+	mu      sync.Mutex
+	uploads map[string]*MultipartUpload
+	locks   keyedMutex // part uploads, complete, abort and reap of the same upload are serialized
+}
+
+func NewMultipartRegistry(dir string) *MultipartRegistry {
+	r := &MultipartRegistry{
+		dir:     dir,
+		uploads: make(map[string]*MultipartUpload),
+	}
+	if err := r.load(); err != nil {
+		log.Printf("WARN: load multipart uploads from %s: %v", dir, err)
+	}
+	return r
+}
+
+func (r *MultipartRegistry) load() error {
+	finfos, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, fi := range finfos {
+		if !fi.IsDir() {
+			continue
+		}
+		dir := filepath.Join(r.dir, fi.Name())
+		data, err := ioutil.ReadFile(filepath.Join(dir, multipartSessionFile))
+		u := &MultipartUpload{}
+		if err == nil {
+			err = json.Unmarshal(data, u)
+		}
+		if err != nil || u.UploadId != fi.Name() {
+			// parts left by old versions or by a crash during initiate, nobody can complete them
+			log.Printf("Remove orphan multipart upload directory: %s", dir)
+			os.RemoveAll(dir)
+			continue
+		}
+		if u.Parts == nil {
+			u.Parts = make(map[int]*MultipartPart)
+		}
+		u.dir = dir
+		r.uploads[u.UploadId] = u
+	}
+	log.Printf("Loaded %d multipart uploads from %s", len(r.uploads), r.dir)
+	return nil
+}
+
+func (r *MultipartRegistry) save(u *MultipartUpload) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(u.dir, multipartSessionFile+".tmp")
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(u.dir, multipartSessionFile))
+}
+
+func newMultipartUploadId() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Create registers a new upload session for key
+func (r *MultipartRegistry) Create(key, owner string, meta FileMeta) (*MultipartUpload, error) {
+	uploadId, err := newMultipartUploadId()
+	if err != nil {
+		return nil, err
+	}
+	u := &MultipartUpload{
+		UploadId:  uploadId,
+		Key:       key,
+		Owner:     owner,
+		Initiated: time.Now(),
+		Parts:     make(map[int]*MultipartPart),
+		Meta:      meta,
+		dir:       filepath.Join(r.dir, uploadId),
+	}
+	if err := os.MkdirAll(u.dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.save(u); err != nil {
+		os.RemoveAll(u.dir)
+		return nil, err
+	}
+	r.uploads[uploadId] = u
+	return u.clone(), nil
+}
+
+// Get returns a snapshot of the upload session
+func (r *MultipartRegistry) Get(uploadId string) (*MultipartUpload, error) {
+	if !reMultipartUploadId.MatchString(uploadId) {
+		return nil, errNoSuchUpload
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.uploads[uploadId]
+	if !ok {
+		return nil, errNoSuchUpload
+	}
+	return u.clone(), nil
+}
+
+// AddPart records a part whose data has already been written to partPath
+func (r *MultipartRegistry) AddPart(uploadId string, part *MultipartPart) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.uploads[uploadId]
+	if !ok {
+		return errNoSuchUpload
+	}
+	u.Parts[part.PartNumber] = part
+	return r.save(u)
+}
+
+// List returns snapshots of all upload sessions, ordered by key and then by upload id,
+// so that listing can be continued from key-marker and upload-id-marker
+func (r *MultipartRegistry) List() []*MultipartUpload {
+	r.mu.Lock()
+	uploads := make([]*MultipartUpload, 0, len(r.uploads))
+	for _, u := range r.uploads {
+		uploads = append(uploads, u.clone())
+	}
+	r.mu.Unlock()
+	sort.Slice(uploads, func(i, j int) bool {
+		if uploads[i].Key != uploads[j].Key {
+			return uploads[i].Key < uploads[j].Key
+		}
+		return uploads[i].UploadId < uploads[j].UploadId
+	})
+	return uploads
+}
+
+// Remove forgets the upload session and deletes all its parts, the caller should hold locks of the upload
+func (r *MultipartRegistry) Remove(uploadId string) error {
+	r.mu.Lock()
+	u, ok := r.uploads[uploadId]
+	delete(r.uploads, uploadId)
+	r.mu.Unlock()
+	if !ok {
+		return errNoSuchUpload
+	}
+	return os.RemoveAll(u.dir)
+}
+
+// Reap removes upload sessions without any activity since deadline,
+// returns how many sessions are removed and the bytes reclaimed.
+func (r *MultipartRegistry) Reap(deadline time.Time) (count int, reclaimed int64) {
+	for _, u := range r.List() {
+		if u.LastActivity().After(deadline) {
+			continue
+		}
+		if size, ok := r.reap(u.UploadId, deadline); ok {
+			log.Printf("Reaped multipart upload %s of %s, last activity %v", u.UploadId, u.Key, u.LastActivity())
+			count++
+			reclaimed += size
+		}
+	}
+	return
+}
+
+// reap removes the upload if it is still inactive, a part may have been uploaded since it was listed
+func (r *MultipartRegistry) reap(uploadId string, deadline time.Time) (int64, bool) {
+	unlock := r.locks.Lock(uploadId)
+	defer unlock()
+	u, err := r.Get(uploadId)
+	if err != nil || u.LastActivity().After(deadline) {
+		return 0, false
+	}
+	size := diskUsage(u.dir)
+	if err := r.Remove(uploadId); err != nil {
+		log.Printf("WARN: reap multipart upload %s: %v", uploadId, err)
+		return 0, false
+	}
+	return size, true
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompleteParts(t *testing.T) {
+	u := &MultipartUpload{
+		Parts: map[int]*MultipartPart{
+			1: {PartNumber: 1, Size: 6, ETag: "f814893777bcc2295fff05f00e508da6"},
+			2: {PartNumber: 2, Size: 5, ETag: "7d793037a0760186574b0282f2f435e7"},
+			4: {PartNumber: 4, Size: 6, ETag: "f814893777bcc2295fff05f00e508da6"},
+		},
+	}
+	parts, err := u.CompleteParts([]CompletePart{
+		{1, `"f814893777bcc2295fff05f00e508da6"`},
+		{2, `"7D793037A0760186574B0282F2F435E7"`},
+	}, 6)
+	assert.Nil(t, err)
+	assert.Equal(t, "e09e4fd6265b36115fe3db32df945d84-2", compositeETag(parts))
+
+	tests := []struct {
+		parts []CompletePart
+		code  string
+	}{
+		{nil, "MalformedXML"},
+		{[]CompletePart{{2, "7d793037a0760186574b0282f2f435e7"}, {1, "f814893777bcc2295fff05f00e508da6"}}, "InvalidPartOrder"},
+		{[]CompletePart{{1, "f814893777bcc2295fff05f00e508da6"}, {3, "7d793037a0760186574b0282f2f435e7"}}, "InvalidPart"},
+		{[]CompletePart{{2, "7d793037a0760186574b0282f2f435e7"}, {4, "f814893777bcc2295fff05f00e508da6"}}, "EntityTooSmall"},
+		{[]CompletePart{{1, "7d793037a0760186574b0282f2f435e7"}}, "InvalidPart"},
+	}
+	for _, v := range tests {
+		_, err := u.CompleteParts(v.parts, 6)
+		if assert.IsType(t, &S3APIError{}, err) {
+			assert.Equal(t, v.code, err.(*S3APIError).Code)
+		}
+	}
+}
+
+func TestListMultipartUploads(t *testing.T) {
+	s := newTestServer(t, map[string]string{"bkt/secret/": ""})
+	initiate := func(path string) string {
+		w := serveTest(s.hUploadOrMkdir, newTestRequest("POST", "/"+path+"?uploads", nil))
+		var result InitiateMultipartUploadResult
+		assert.NoError(t, xml.Unmarshal(w.Body.Bytes(), &result))
+		return result.UploadId
+	}
+	id := initiate("bkt/a.bin")
+	secretID := initiate("bkt/secret/b.bin")
+	assert.NotEmpty(t, secretID)
+	w := serveTest(s.hUploadOrMkdir, newTestRequest("PUT", "/bkt/a.bin?partNumber=1&uploadId="+id, strings.NewReader("hello")))
+	assert.Equal(t, http.StatusOK, w.Code)
+	writeTestFiles(t, s, map[string]string{"bkt/secret/" + YAMLCONF: "upload: false\n"})
+
+	w = serveTest(s.hIndex, newTestRequest("GET", "/bkt/a.bin?uploadId="+id, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var parts ListPartsResult
+	assert.NoError(t, xml.Unmarshal(w.Body.Bytes(), &parts))
+	if assert.Len(t, parts.Parts, 1) {
+		assert.Equal(t, int64(5), parts.Parts[0].Size)
+	}
+
+	// uploads in directories the requester can not upload to are hidden
+	w = serveTest(s.hIndex, newTestRequest("GET", "/bkt?uploads", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var uploads ListMultipartUploadsResult
+	assert.NoError(t, xml.Unmarshal(w.Body.Bytes(), &uploads))
+	if assert.Len(t, uploads.Uploads, 1) {
+		assert.Equal(t, "a.bin", uploads.Uploads[0].Key)
+		assert.Equal(t, id, uploads.Uploads[0].UploadId)
+	}
+	assert.Equal(t, http.StatusForbidden, serveTest(s.hIndex, newTestRequest("GET", "/bkt/secret/b.bin?uploadId="+secretID, nil)).Code)
+
+	s.Upload = false
+	assert.Equal(t, http.StatusForbidden, serveTest(s.hIndex, newTestRequest("GET", "/bkt?uploads", nil)).Code)
+	assert.Equal(t, http.StatusForbidden, serveTest(s.hIndex, newTestRequest("GET", "/bkt/a.bin?uploadId="+id, nil)).Code)
+}
+
+func TestListMultipartUploadsPagination(t *testing.T) {
+	s := newTestServer(t, map[string]string{"bkt/": ""})
+	var want []string
+	for i := 0; i < 5; i++ {
+		_, err := s.multipartUploads().Create("bkt/a.bin", "", FileMeta{})
+		assert.NoError(t, err)
+	}
+	_, err := s.multipartUploads().Create("bkt/b.bin", "", FileMeta{})
+	assert.NoError(t, err)
+	for _, u := range s.multipartUploads().List() {
+		want = append(want, u.Key+" "+u.UploadId)
+	}
+
+	var got []string
+	query := "uploads&max-uploads=2"
+	for page := 0; page < 10; page++ {
+		w := serveTest(s.hIndex, newTestRequest("GET", "/bkt?"+query, nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		var result ListMultipartUploadsResult
+		assert.NoError(t, xml.Unmarshal(w.Body.Bytes(), &result))
+		for _, u := range result.Uploads {
+			got = append(got, "bkt/"+u.Key+" "+u.UploadId)
+		}
+		if !result.IsTruncated {
+			break
+		}
+		query = "uploads&max-uploads=2&key-marker=" + result.NextKeyMarker + "&upload-id-marker=" + result.NextUploadIdMarker
+	}
+	assert.Len(t, got, 6)
+	assert.Equal(t, want, got)
+}
+
+func TestMultipartRegistry(t *testing.T) {
+	dir := t.TempDir()
+	r := NewMultipartRegistry(dir)
+	u, err := r.Create("bkt/a.bin", "alice@example.com", FileMeta{ContentType: "text/plain"})
+	assert.NoError(t, err)
+	assert.Regexp(t, reMultipartUploadId, u.UploadId)
+	assert.NoError(t, r.AddPart(u.UploadId, &MultipartPart{PartNumber: 1, Size: 5, ETag: "5d41402abc4b2a76b9719d911017c592"}))
+	assert.Equal(t, errNoSuchUpload, r.AddPart("0123456789abcdef0123456789abcdef", &MultipartPart{PartNumber: 1}))
+	for _, id := range []string{"", "123456", "../" + u.UploadId} {
+		_, err := r.Get(id)
+		assert.Equal(t, errNoSuchUpload, err, id)
+	}
+
+	// sessions survive restarts, directories without a valid record are removed
+	os.MkdirAll(filepath.Join(dir, "orphan"), 0755)
+	r = NewMultipartRegistry(dir)
+	loaded, err := r.Get(u.UploadId)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "bkt/a.bin", loaded.Key)
+		assert.Equal(t, "alice@example.com", loaded.Owner)
+		assert.Equal(t, "text/plain", loaded.Meta.ContentType)
+		assert.Len(t, loaded.Parts, 1)
+	}
+	assert.False(t, IsExists(filepath.Join(dir, "orphan")))
+
+	assert.NoError(t, r.Remove(u.UploadId))
+	assert.Empty(t, r.List())
+	assert.Equal(t, errNoSuchUpload, r.Remove(u.UploadId))
+}
+
+func TestMultipartUploadBoundToKey(t *testing.T) {
+	s := newTestServer(t, nil)
+	u, err := s.multipartUploads().Create("bkt/a.bin", "", FileMeta{})
+	assert.NoError(t, err)
+
+	// upload id of another key is refused
+	w := serveTest(s.hUploadOrMkdir, newTestRequest("PUT", "/bkt/b.bin?partNumber=1&uploadId="+u.UploadId, strings.NewReader("hello")))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "NoSuchUpload")
+	w = serveTest(s.hUploadOrMkdir, newTestRequest("PUT", "/bkt/a.bin?partNumber=1&uploadId="+u.UploadId, strings.NewReader("hello")))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"5d41402abc4b2a76b9719d911017c592"`, w.Header().Get("ETag"))
+
+	w = serveTest(s.hDelete, newTestRequest("DELETE", "/bkt/a.bin?uploadId="+u.UploadId, nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	_, err = s.multipartUploads().Get(u.UploadId)
+	assert.Equal(t, errNoSuchUpload, err)
+}
+
+func TestReapMultipartUploads(t *testing.T) {
+	s := newTestServer(t, nil)
+	r := s.multipartUploads()
+	old, err := r.Create("bkt/old.bin", "", FileMeta{})
+	assert.NoError(t, err)
+	ioutil.WriteFile(old.partPath(1), []byte("hello"), 0644)
+	r.AddPart(old.UploadId, &MultipartPart{PartNumber: 1, Size: 5, LastModified: time.Now().Add(-2 * time.Hour)})
+	deadline := time.Now()
+	time.Sleep(time.Millisecond)
+	live, err := r.Create("bkt/live.bin", "", FileMeta{})
+	assert.NoError(t, err)
+
+	// disabled
+	s.reapMultipartUploads()
+	assert.Len(t, r.List(), 2)
+
+	count, reclaimed := r.Reap(deadline)
+	assert.Equal(t, 1, count)
+	assert.True(t, reclaimed >= 5)
+	_, err = r.Get(old.UploadId)
+	assert.Equal(t, errNoSuchUpload, err)
+	assert.False(t, IsExists(old.partPath(1)))
+	_, err = r.Get(live.UploadId)
+	assert.NoError(t, err)
+
+	s.MultipartExpire = time.Hour
+	s.reapMultipartUploads()
+	assert.Len(t, r.List(), 1)
+}
+
+func TestReapWaitsForPartUpload(t *testing.T) {
+	s := newTestServer(t, nil)
+	r := s.multipartUploads()
+	u, err := r.Create("bkt/a.bin", "", FileMeta{})
+	assert.NoError(t, err)
+	deadline := time.Now().Add(time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+
+	// a part is being uploaded when the reaper comes
+	unlock := r.locks.Lock(u.UploadId)
+	done := make(chan int)
+	go func() {
+		count, _ := r.Reap(deadline)
+		done <- count
+	}()
+	time.Sleep(20 * time.Millisecond)
+	_, err = r.Get(u.UploadId)
+	assert.NoError(t, err)
+	ioutil.WriteFile(u.partPath(1), []byte("hello"), 0644)
+	r.AddPart(u.UploadId, &MultipartPart{PartNumber: 1, Size: 5, LastModified: time.Now()})
+	unlock()
+
+	assert.Equal(t, 0, <-done)
+	_, err = r.Get(u.UploadId)
+	assert.NoError(t, err)
+	assert.True(t, IsExists(u.partPath(1)))
+}
+
+func TestCompleteMultipartUpload(t *testing.T) {
+	s := newTestServer(t, map[string]string{"bkt/a.txt": "old"})
+	upload := func() string {
+		u, err := s.multipartUploads().Create("bkt/a.txt", "", FileMeta{})
+		assert.NoError(t, err)
+		for i, data := range []string{"hello", " world"} {
+			w := serveTest(s.hUploadOrMkdir, newTestRequest("PUT", fmt.Sprintf("/bkt/a.txt?partNumber=%d&uploadId=%s", i+1, u.UploadId), strings.NewReader(data)))
+			assert.Equal(t, http.StatusOK, w.Code)
+		}
+		return u.UploadId
+	}
+	complete := func(id string) *httptest.ResponseRecorder {
+		body := `<CompleteMultipartUpload>
+			<Part><PartNumber>1</PartNumber><ETag>"5d41402abc4b2a76b9719d911017c592"</ETag></Part>
+			<Part><PartNumber>2</PartNumber><ETag>"b7913aa15c43be7d534b4eec6e99e8a0"</ETag></Part>
+		</CompleteMultipartUpload>`
+		return serveTest(s.hUploadOrMkdir, newTestRequest("POST", "/bkt/a.txt?uploadId="+id, strings.NewReader(body)))
+	}
+
+	// a missing part fails the merge, the old file is not touched
+	id := upload()
+	u, _ := s.multipartUploads().Get(id)
+	os.Remove(u.partPath(2))
+	assert.Equal(t, http.StatusConflict, complete(id).Code)
+	assert.Equal(t, "old", readTestFile(s, "bkt/a.txt"))
+	files, _ := ioutil.ReadDir(filepath.Join(s.Root, "bkt"))
+	assert.Len(t, files, 1, "temp file should be removed")
+
+	id = upload()
+	w := complete(id)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "hello world", readTestFile(s, "bkt/a.txt"))
+	assert.Regexp(t, `^"[0-9a-f]{32}-2"$`, w.Header().Get("ETag"))
+	_, err := s.multipartUploads().Get(id)
+	assert.Equal(t, errNoSuchUpload, err)
+}
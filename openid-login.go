@@ -33,6 +33,23 @@ func init() {
 	gob.Register(&M{})
 }
 
+type userContextKey struct{}
+
+// currentUser returns the logged in user of the request, nil for anonymous.
+// Requests signed with s3 access keys act as the user of the key.
+func currentUser(r *http.Request) *UserInfo {
+	if user, ok := r.Context().Value(userContextKey{}).(*UserInfo); ok {
+		// nil is anonymous, eg: presigned urls
+		return user
+	}
+	session, err := store.Get(r, defaultSessionName)
+	if err != nil {
+		return nil
+	}
+	userInfo, _ := session.Values["user"].(*UserInfo)
+	return userInfo
+}
+
 func handleOpenID(loginUrl string, secure bool) {
 	http.HandleFunc("/-/login", func(w http.ResponseWriter, r *http.Request) {
 		nextUrl := r.FormValue("next")
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// upload policy of AccessConf, set in .ghs.yml and inherited by sub directories
+//
+//	maxFileSize: 2GB
+//	allowedExtensions: [.apk, .ipa, .zip]
+//	deniedExtensions: [.exe, .bat, .sh]
+//	allowedMimeTypes: [application/zip, image/*]
+
+func errFileTooLarge(max ByteSize) error {
+	return &S3APIError{http.StatusRequestEntityTooLarge, "EntityTooLarge", fmt.Sprintf("File is larger than the max allowed size %v", max)}
+}
+
+func normalizeExtension(ext string) string {
+	ext = strings.ToLower(strings.TrimSpace(ext))
+	if ext != "" && !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return ext
+}
+
+// checkFileSize works before anything is written if the size is known, eg: from Content-Length
+func (c *AccessConf) checkFileSize(size int64) error {
+	if c.MaxFileSize > 0 && size > int64(c.MaxFileSize) {
+		return errFileTooLarge(c.MaxFileSize)
+	}
+	return nil
+}
+
+func (c *AccessConf) checkExtension(filename string) error {
+	ext := normalizeExtension(filepath.Ext(filename))
+	for _, denied := range c.DeniedExtensions {
+		if ext != "" && ext == normalizeExtension(denied) {
+			return &S3APIError{http.StatusForbidden, "AccessDenied", "Uploading " + ext + " files is not allowed"}
+		}
+	}
+	if len(c.AllowedExtensions) == 0 {
+		return nil
+	}
+	for _, allowed := range c.AllowedExtensions {
+		if ext == normalizeExtension(allowed) {
+			return nil
+		}
+	}
+	return &S3APIError{http.StatusForbidden, "AccessDenied", "Only " + strings.Join(c.AllowedExtensions, ", ") + " files are allowed"}
+}
+
+// checkContentType checks the type sniffed from the first 512 bytes of the file,
+// the Content-Type sent by the client is not trusted
+func (c *AccessConf) checkContentType(head []byte) error {
+	if len(c.AllowedMimeTypes) == 0 {
+		return nil
+	}
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	for _, allowed := range c.AllowedMimeTypes {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed == sniffed || allowed == "*/*" {
+			return nil
+		}
+		if strings.HasSuffix(allowed, "/*") && strings.HasPrefix(sniffed, strings.TrimSuffix(allowed, "*")) {
+			return nil
+		}
+	}
+	return &S3APIError{http.StatusUnsupportedMediaType, "InvalidArgument", "Content type " + sniffed + " is not allowed"}
+}
+
+// checkUploadedFile checks the size and the content of a written but not yet committed file
+func (c *AccessConf) checkUploadedFile(f *os.File) error {
+	if c.MaxFileSize <= 0 && len(c.AllowedMimeTypes) == 0 {
+		return nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := c.checkFileSize(info.Size()); err != nil {
+		return err
+	}
+	head := make([]byte, 512)
+	n, err := f.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return c.checkContentType(head[:n])
+}
+
+// checkStoredFile checks a file which is already on disk, eg: moved files, name is the one it gets
+func (c *AccessConf) checkStoredFile(name, path string) error {
+	if err := c.checkExtension(name); err != nil {
+		return err
+	}
+	if c.MaxFileSize <= 0 && len(c.AllowedMimeTypes) == 0 {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return c.checkUploadedFile(f)
+}
+
+// checkZipEntry checks a file in a zip before it is extracted,
+// the size in the zip header can be trusted as reading the entry fails beyond it
+func (c *AccessConf) checkZipEntry(name string, f *zip.File) error {
+	if err := c.checkExtension(name); err != nil {
+		return err
+	}
+	if err := c.checkFileSize(int64(f.UncompressedSize64)); err != nil {
+		return err
+	}
+	if len(c.AllowedMimeTypes) == 0 {
+		return nil
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(rc, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	return c.checkContentType(head[:n])
+}
+
+// maxSizeReader fails the upload as soon as more than max bytes are received
+type maxSizeReader struct {
+	r   io.Reader
+	n   int64
+	max ByteSize
+}
+
+func (c *AccessConf) limitReader(r io.Reader) io.Reader {
+	if c.MaxFileSize <= 0 {
+		return r
+	}
+	return &maxSizeReader{r: r, n: int64(c.MaxFileSize), max: c.MaxFileSize}
+}
+
+func (l *maxSizeReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, errFileTooLarge(l.max)
+	}
+	return n, err
+}
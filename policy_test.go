@@ -0,0 +1,105 @@
+package main
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadPolicy(t *testing.T) {
+	c := &AccessConf{
+		MaxFileSize:       10,
+		AllowedExtensions: []string{"apk", ".ZIP"},
+		DeniedExtensions:  []string{".exe"},
+		AllowedMimeTypes:  []string{"application/zip", "image/*"},
+	}
+	assert.NoError(t, c.checkExtension("app.apk"))
+	assert.NoError(t, c.checkExtension("pkg.zip"))
+	assert.Error(t, c.checkExtension("setup.exe"))
+	assert.Error(t, c.checkExtension("README"))
+
+	assert.NoError(t, c.checkFileSize(10))
+	assert.Equal(t, "EntityTooLarge", c.checkFileSize(11).(*S3APIError).Code)
+	_, err := ioutil.ReadAll(c.limitReader(strings.NewReader(strings.Repeat("a", 11))))
+	assert.Error(t, err)
+
+	assert.NoError(t, c.checkContentType([]byte("PK\x03\x04")))
+	assert.NoError(t, c.checkContentType([]byte("\x89PNG\x0D\x0A\x1A\x0A")))
+	assert.Error(t, c.checkContentType([]byte("#!/bin/sh\nrm -rf /")))
+}
+
+func TestUploadPolicyInherit(t *testing.T) {
+	root, err := ioutil.TempDir("", "ghs-policy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+	os.MkdirAll(filepath.Join(root, "drop/apps"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "drop", YAMLCONF), []byte("maxFileSize: 2GB\ndeniedExtensions: [.exe]\n"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "drop/apps", YAMLCONF), []byte("allowedExtensions: [.apk, .ipa]\n"), 0644)
+
+	s := &HTTPStaticServer{Root: root}
+	c := s.readAccessConf("drop/apps/app.apk")
+	assert.Equal(t, ByteSize(2<<30), c.MaxFileSize)
+	assert.Equal(t, []string{".exe"}, c.DeniedExtensions)
+	assert.Equal(t, []string{".apk", ".ipa"}, c.AllowedExtensions)
+}
+
+func TestUploadPolicyOfStoredFiles(t *testing.T) {
+	s := newTestServer(t, map[string]string{
+		"drop/" + YAMLCONF:          "upload: true\ndelete: true\nmaxFileSize: 5\nallowedMimeTypes: [text/*]\n",
+		"drop/sub/" + YAMLCONF:      "deniedExtensions: [.sh]\n",
+		"big/large.txt":             "0123456789",
+		"big/dir/large.txt":         "0123456789",
+		"big/small.txt":             "01234",
+		"drop/a.txt":                "new",
+		"drop/.ghs-versions/a.txt/": "",
+	})
+
+	// move applies size and content type rules of the destination
+	req := newTestRequest("MOVE", "/big/large.txt", nil)
+	_, err := s.move(req, moveRequest{Src: "big/large.txt", Dst: "drop/large.txt"})
+	assert.Equal(t, "EntityTooLarge", err.(*S3APIError).Code)
+	_, err = s.move(req, moveRequest{Src: "big/dir", Dst: "drop/dir"})
+	assert.Equal(t, "EntityTooLarge", err.(*S3APIError).Code)
+	assert.True(t, testFileExists(s, "big/dir/large.txt"))
+	_, err = s.move(req, moveRequest{Src: "big/small.txt", Dst: "drop/small.txt"})
+	assert.NoError(t, err)
+
+	// a version saved before the rule is not restored
+	id := "20200102T030405.000000000Z"
+	writeTestFiles(t, s, map[string]string{"drop/.ghs-versions/a.txt/" + id: "0123456789"})
+	w := serveTest(s.hVersionRestore, newTestRequest("POST", "/drop/a.txt?op=restore&version="+id, nil))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal(t, "new", readTestFile(s, "drop/a.txt"))
+
+	// unzip checks every entry with the rules of its directory before anything is written
+	writeZip := func(name string, files map[string]string) {
+		f, err := os.Create(filepath.Join(s.Root, name))
+		assert.NoError(t, err)
+		zw := zip.NewWriter(f)
+		for name, content := range files {
+			w, _ := zw.Create(name)
+			w.Write([]byte(content))
+		}
+		zw.Close()
+		f.Close()
+	}
+	for _, files := range []map[string]string{
+		{"ok.txt": "ok", "large.txt": "0123456789"},
+		{"ok.txt": "ok", "x.png": "\x89PNG\x0D\x0A\x1A\x0A"},
+		{"ok.txt": "ok", "sub/x.sh": "echo"},
+	} {
+		writeZip("drop/a.zip", files)
+		err := s.unzip(newTestRequest("POST", "/drop/a.zip", nil), "drop/a.zip")
+		assert.Error(t, err)
+		assert.False(t, testFileExists(s, "drop/ok.txt"))
+	}
+	writeZip("drop/a.zip", map[string]string{"ok.txt": "ok", "sub/x.txt": "echo"})
+	assert.NoError(t, s.unzip(newTestRequest("POST", "/drop/a.zip", nil), "drop/a.zip"))
+	assert.Equal(t, "echo", readTestFile(s, "drop/sub/x.txt"))
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// presignAccessKey is the access key of urls presigned by the server itself
+const presignAccessKey = "GHSPRESIGN"
+
+const defaultPresignExpires = time.Hour
+
+func newPresignSecret() string {
+	buf := make([]byte, 32)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// presignURL returns a sigv4 presigned url of method and path, path is the one to appear in the url, eg: /bucket/key
+func presignURL(method, scheme, host, path string, cred S3Credential, region string, now time.Time, expires time.Duration) string {
+	now = now.UTC()
+	a := &sigV4Auth{
+		AccessKey:     cred.AccessKey,
+		Date:          now,
+		Scope:         now.Format("20060102") + "/" + region + "/s3/aws4_request",
+		SignedHeaders: []string{"host"},
+		Presigned:     true,
+		Expires:       expires,
+	}
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", sigV4Algorithm)
+	query.Set("X-Amz-Credential", a.AccessKey+"/"+a.Scope)
+	query.Set("X-Amz-Date", now.Format(sigV4TimeFormat))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expires/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	req := &http.Request{
+		Method: method,
+		Host:   host,
+		URL:    &url.URL{Path: path, RawQuery: query.Encode()},
+		Header: make(http.Header),
+	}
+	query.Set("X-Amz-Signature", hex.EncodeToString(hmacSHA256(a.signingKey(cred.SecretKey), a.stringToSign(req))))
+	return scheme + "://" + host + sigV4Escape(path, false) + "?" + query.Encode()
+}
+
+type presignGrantKey struct{}
+
+// presignGrant is the path signed in an url presigned by the server,
+// upload permission was checked when the url was generated
+type presignGrant struct {
+	Path string // url path after virtual-host rewriting, eg: /bucket/key
+}
+
+// isPresignGrant reports whether the request comes with an url presigned by the server
+func isPresignGrant(r *http.Request) bool {
+	_, ok := r.Context().Value(presignGrantKey{}).(*presignGrant)
+	return ok
+}
+
+// canUpload reports whether the grant allows the request to upload,
+// only a single file PUT to exactly the signed path, not folder uploads or mkdir
+func (g *presignGrant) canUpload(r *http.Request) bool {
+	if r.Method != "PUT" || r.URL.Path != g.Path {
+		return false
+	}
+	// 没有body的PUT是新建文件夹
+	if r.ContentLength <= 0 || strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		return false
+	}
+	return true
+}
+
+// hPresign generates presigned GET/PUT urls, so that files can be downloaded or uploaded without credentials.
+//
+//	POST /-/presign path=foo/bar.txt&method=PUT&expires=600
+func (s *HTTPStaticServer) hPresign(w http.ResponseWriter, r *http.Request) {
+	path := r.FormValue("path")
+	if !IsSafePath(path) || strings.Trim(path, "/") == "" {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	path = "/" + strings.TrimPrefix(filepath.ToSlash(filepath.Clean("/"+path)), "/")
+
+	method := strings.ToUpper(r.FormValue("method"))
+	if method == "" {
+		method = "GET"
+	}
+	if method != "GET" && method != "PUT" {
+		http.Error(w, "Method should be GET or PUT", http.StatusBadRequest)
+		return
+	}
+	expires := defaultPresignExpires
+	if value := r.FormValue("expires"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 1 || seconds > sigV4MaxExpires {
+			http.Error(w, "expires should be seconds between 1 and 604800", http.StatusBadRequest)
+			return
+		}
+		expires = time.Duration(seconds) * time.Second
+	}
+
+	auth := s.readAccessConf(path)
+	if !auth.canUpload(r) {
+		http.Error(w, "Presign forbidden", http.StatusForbidden)
+		return
+	}
+
+	scheme := r.Header.Get("X-Forwarded-Proto")
+	if scheme == "" {
+		scheme = "http"
+	}
+	cred := S3Credential{AccessKey: presignAccessKey, SecretKey: s.S3PresignSecret}
+	now := time.Now()
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"url":       presignURL(method, scheme, r.Host, path, cred, s.S3Region, now, expires),
+		"method":    method,
+		"path":      path,
+		"expires":   int(expires / time.Second),
+		"expiresAt": now.Add(expires).UnixNano() / 1e6,
+	})
+}
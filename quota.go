@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Quota limits total size and file count of the directory where it is set in .ghs.yml
+//
+//	quota:
+//	  size: 10GB
+//	  files: 10000
+type Quota struct {
+	Size  ByteSize `yaml:"size" json:"size,omitempty"`
+	Files int64    `yaml:"files" json:"files,omitempty"`
+
+	dir string // relative to root in slash form, "" is root
+}
+
+// quotaError is answered with 507 Insufficient Storage
+type quotaError struct {
+	Quota     *Quota
+	UsedSize  int64
+	UsedFiles int64
+	Size      int64 // requested by the rejected write
+	Files     int64
+}
+
+func (e *quotaError) sizeExceeded() bool {
+	return e.Quota.Size > 0 && e.UsedSize+e.Size > int64(e.Quota.Size)
+}
+
+func (e *quotaError) Error() string {
+	dir := "/" + e.Quota.dir
+	if e.sizeExceeded() {
+		return fmt.Sprintf("Quota of %s exceeded, %v of %v used, %v more requested", dir, ByteSize(e.UsedSize), e.Quota.Size, ByteSize(e.Size))
+	}
+	return fmt.Sprintf("Quota of %s exceeded, %d of %d files used", dir, e.UsedFiles, e.Quota.Files)
+}
+
+func (e *quotaError) json() map[string]interface{} {
+	return map[string]interface{}{
+		"success":     false,
+		"description": e.Error(),
+		"code":        http.StatusInsufficientStorage,
+		"quota": map[string]interface{}{
+			"path":      "/" + e.Quota.dir,
+			"size":      int64(e.Quota.Size),
+			"files":     e.Quota.Files,
+			"usedSize":  e.UsedSize,
+			"usedFiles": e.UsedFiles,
+		},
+	}
+}
+
+// quotaUsage counts what is written since the last index, the index is rebuilt only every 10 minutes
+type quotaUsage struct {
+	mu    sync.Mutex
+	size  map[string]int64
+	files map[string]int64
+}
+
+func (u *quotaUsage) add(dir string, size, files int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.size == nil {
+		u.size = make(map[string]int64)
+		u.files = make(map[string]int64)
+	}
+	u.size[dir] += size
+	u.files[dir] += files
+}
+
+func (u *quotaUsage) get(dir string) (size, files int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.size[dir], u.files[dir]
+}
+
+func (u *quotaUsage) reset() {
+	u.mu.Lock()
+	u.size, u.files = nil, nil
+	u.mu.Unlock()
+}
+
+// storedUsage is a version store or a trash entry found by the last index,
+// path is where its files belong to, eg: dir/.ghs-versions counts in quotas of dir, a deleted file in quotas of where it was
+type storedUsage struct {
+	Path  string
+	Size  int64
+	Files int64
+}
+
+// storedUsages returns the version stores in the indexed directories and the entries in the trash
+func (s *HTTPStaticServer) storedUsages(dirs []string) []storedUsage {
+	usages := make([]storedUsage, 0)
+	for _, dir := range dirs {
+		versionsDir := filepath.Join(s.Root, dir, versionsDirName)
+		if isDir(versionsDir) {
+			size, files := pathUsage(versionsDir)
+			usages = append(usages, storedUsage{filepath.ToSlash(filepath.Join(dir, versionsDirName)), size, files})
+		}
+	}
+	for _, e := range s.trashEntries() {
+		usages = append(usages, storedUsage{e.Path, e.Size, e.Files})
+	}
+	return usages
+}
+
+// dirUsage counts files in dir, together with its old versions and the files deleted from it which are still in the trash
+func (s *HTTPStaticServer) dirUsage(dir string) (size, files int64) {
+	size, files = s.quotaUsage.get(dir)
+	dirSizeMu.Lock()
+	for _, u := range s.stored {
+		if inDir(u.Path, dir) {
+			size += u.Size
+			files += u.Files
+		}
+	}
+	dirSizeMu.Unlock()
+	return size + s.historyDirSize(dir), files + s.historyDirFiles(dir)
+}
+
+// checkQuota checks whether size bytes and files files more can be written under every quota of ac
+func (s *HTTPStaticServer) checkQuota(ac AccessConf, size, files int64) error {
+	for _, q := range ac.quotas {
+		usedSize, usedFiles := s.dirUsage(q.dir)
+		if (q.Size > 0 && size > 0 && usedSize+size > int64(q.Size)) || (q.Files > 0 && files > 0 && usedFiles+files > q.Files) {
+			return &quotaError{q, usedSize, usedFiles, size, files}
+		}
+	}
+	return nil
+}
+
+// addQuotaUsage records a finished write, size is the change of bytes (negative when a file is overwritten by a smaller one)
+func (s *HTTPStaticServer) addQuotaUsage(ac AccessConf, size, files int64) {
+	for _, q := range ac.quotas {
+		s.quotaUsage.add(q.dir, size, files)
+	}
+}
+
+// setQuotaDir binds the quota just read from the .ghs.yml in dir to it, quotas of parent directories still apply
+func (ac *AccessConf) setQuotaDir(root, dir string) {
+	q := ac.Quota
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return
+	}
+	q.dir = filepath.ToSlash(rel)
+	if q.dir == "." {
+		q.dir = ""
+	}
+	for _, parent := range ac.quotas {
+		if parent.dir == q.dir {
+			return
+		}
+	}
+	ac.quotas = append(ac.quotas[:len(ac.quotas):len(ac.quotas)], q)
+}
+
+// quotaDelta is how much usage changes when a file of size is written to path,
+// a replaced file still counts if it is kept as a version
+func quotaDelta(ac AccessConf, path string, size int64) (int64, int64) {
+	if info, err := os.Stat(path); err == nil && !info.IsDir() && !(ac.Versioning.Enable && !isReadProtected(path)) {
+		return size - info.Size(), 0
+	}
+	return size, 1
+}
+
+// checkQuotaSize is used before writing when the size is known, a negative size is unknown and skipped
+func (s *HTTPStaticServer) checkQuotaSize(ac AccessConf, path string, size int64) error {
+	if len(ac.quotas) == 0 || size < 0 {
+		return nil
+	}
+	sizeDelta, filesDelta := quotaDelta(ac, path, size)
+	return s.checkQuota(ac, sizeDelta, filesDelta)
+}
+
+// checkQuotaFile checks the written but not committed f which is going to replace path,
+// the returned usage change should be recorded with addQuotaUsage after commit
+func (s *HTTPStaticServer) checkQuotaFile(ac AccessConf, f *os.File, path string) (size, files int64, err error) {
+	if len(ac.quotas) == 0 {
+		return 0, 0, nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	size, files = quotaDelta(ac, path, info.Size())
+	return size, files, s.checkQuota(ac, size, files)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuota(t *testing.T) {
+	root, err := ioutil.TempDir("", "ghs-quota")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+	os.MkdirAll(filepath.Join(root, "team/sub"), 0755)
+	os.MkdirAll(filepath.Join(root, "teambar"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "team", YAMLCONF), []byte("quota:\n  size: 100\n  files: 3\n"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "team/sub/a.txt"), make([]byte, 40), 0644)
+	ioutil.WriteFile(filepath.Join(root, "teambar/b.txt"), make([]byte, 1000), 0644)
+
+	s := &HTTPStaticServer{Root: root}
+	s.makeIndex()
+	ac := s.readAccessConf("team/sub/new.txt")
+	if assert.Len(t, ac.quotas, 1) {
+		assert.Equal(t, "team", ac.quotas[0].dir)
+	}
+
+	// .ghs.yml and a.txt are counted, teambar is not
+	size, files := s.dirUsage("team")
+	assert.Equal(t, int64(40+30), size)
+	assert.Equal(t, int64(2), files)
+
+	assert.NoError(t, s.checkQuota(ac, 30, 1))
+	err = s.checkQuota(ac, 31, 1)
+	if assert.IsType(t, &quotaError{}, err) {
+		assert.True(t, err.(*quotaError).sizeExceeded())
+	}
+
+	s.addQuotaUsage(ac, 10, 1)
+	assert.Error(t, s.checkQuota(ac, 1, 1))
+	assert.NoError(t, s.checkQuota(ac, 1, 0))
+}
+
+func TestQuotaUnzip(t *testing.T) {
+	s := newTestServer(t, map[string]string{
+		"team/" + YAMLCONF:                "upload: true\nquota:\n  size: 1000\n",
+		"team/.ghs-versions/a.txt/v1":     "versions count",
+		"team/" + trashDirName + "/x.txt": "not a trash entry",
+	})
+	writeZip := func(name string, files ...string) {
+		f, err := os.Create(filepath.Join(s.Root, name))
+		assert.NoError(t, err)
+		zw := zip.NewWriter(f)
+		for _, name := range files {
+			w, _ := zw.Create(name)
+			w.Write([]byte("0123456789"))
+		}
+		zw.Close()
+		f.Close()
+	}
+	used := func() int64 {
+		size, _ := s.dirUsage("team")
+		return size
+	}
+	base := used()
+	assert.Equal(t, int64(len("upload: true\nquota:\n  size: 1000\n")+len("versions count")), base)
+
+	writeZip("team/a.zip", "a.txt", "b/c.txt")
+	assert.NoError(t, s.unzip(newTestRequest("POST", "/team/a.zip", nil), "team/a.zip"))
+	assert.Equal(t, base+20, used())
+
+	// fails after a.txt is written, as the directory a.txt/ can not be created
+	writeZip("team/b.zip", "d.txt", "d.txt/e.txt")
+	assert.Error(t, s.unzip(newTestRequest("POST", "/team/b.zip", nil), "team/b.zip"))
+	assert.Equal(t, base+20, used())
+}
+
+func TestQuotaVersionsAndTrash(t *testing.T) {
+	s := newTestServer(t, map[string]string{
+		"team/" + YAMLCONF: "upload: true\ndelete: true\nquota:\n  size: 1000\nversioning:\n  enable: true\n  maxVersions: 1\n",
+		"team/a.txt":       "0123456789",
+		"other/b.txt":      "01234",
+	})
+	s.S3 = true
+	base, _ := s.dirUsage("team")
+	used := func() int64 {
+		size, _ := s.dirUsage("team")
+		return size - base
+	}
+	put := func(path, content string) {
+		w := serveTest(s.hUploadOrMkdir, newS3Request("PUT", "/"+path, strings.NewReader(content)))
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+	reindex := func() {
+		before := used()
+		s.makeIndex()
+		assert.Equal(t, before, used())
+	}
+
+	// the overwritten file is kept as a version, the older version is pruned
+	put("team/a.txt", "01234")
+	assert.Equal(t, int64(5), used())
+	put("team/a.txt", "012")
+	assert.Equal(t, int64(-2), used())
+	reindex()
+
+	// deleted files stay in versions or the trash until they are purged
+	req := newTestRequest("DELETE", "/team/a.txt", nil)
+	assert.NoError(t, s.deletePath(req, "team/a.txt"))
+	assert.Equal(t, int64(-2-5), used())
+	reindex()
+
+	s.Trash = true
+	writeTestFiles(t, s, map[string]string{"team/sub/" + YAMLCONF: "versioning:\n  enable: false\n", "team/sub/c.txt": "0123"})
+	s.makeIndex()
+	base, _ = s.dirUsage("team")
+	assert.NoError(t, s.deletePath(req, "team/sub/c.txt"))
+	assert.Equal(t, int64(0), used())
+	reindex()
+	if entries := s.trashEntries(); assert.Len(t, entries, 1) {
+		assert.NoError(t, s.purgeTrash(entries[0]))
+	}
+	assert.Equal(t, int64(-4), used())
+
+	// removed for good without trash
+	s.Trash = false
+	writeTestFiles(t, s, map[string]string{"team/sub/d.txt": "0123"})
+	s.makeIndex()
+	base, _ = s.dirUsage("team")
+	assert.NoError(t, s.deletePath(req, "team/sub/d.txt"))
+	assert.Equal(t, int64(-4), used())
+	reindex()
+}
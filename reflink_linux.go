@@ -0,0 +1,20 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// ficlone is FICLONE of linux/fs.h
+const ficlone = 0x40049409
+
+// reflink makes dst share the data of src without copying, it works only on copy-on-write filesystems like btrfs and xfs
+func reflink(dst, src *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,892 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// s3TimeFormat is the ISO 8601 time format used in s3 xml responses
+const s3TimeFormat = "2006-01-02T15:04:05.000Z"
+
+// S3Error is the xml body returned by s3 compatible endpoints when a request fails
+type S3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource,omitempty"`
+
+	ProposedSize   int64 `xml:"ProposedSize,omitempty"`
+	MinSizeAllowed int64 `xml:"MinSizeAllowed,omitempty"`
+	MaxSizeAllowed int64 `xml:"MaxSizeAllowed,omitempty"`
+}
+
+// S3APIError is an error with its s3 error code
+type S3APIError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *S3APIError) Error() string {
+	return e.Message
+}
+
+func writeS3XML(w http.ResponseWriter, status int, v interface{}) {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		log.Println("s3 xml marshal:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
+
+func writeS3Error(w http.ResponseWriter, req *http.Request, status int, code, message string) {
+	writeS3XML(w, status, S3Error{
+		Code:     code,
+		Message:  message,
+		Resource: req.URL.Path,
+	})
+}
+
+// writeS3EntitySizeError writes EntityTooLarge or EntityTooSmall error with the size limit
+func writeS3EntitySizeError(w http.ResponseWriter, req *http.Request, code string, size, limit int64) {
+	e := S3Error{
+		Code:         code,
+		Resource:     req.URL.Path,
+		ProposedSize: size,
+	}
+	if code == "EntityTooLarge" {
+		e.Message = "Your proposed upload exceeds the maximum allowed size."
+		e.MaxSizeAllowed = limit
+	} else {
+		e.Message = "Your proposed upload is smaller than the minimum allowed size."
+		e.MinSizeAllowed = limit
+	}
+	writeS3XML(w, http.StatusBadRequest, e)
+}
+
+// writeS3APIError writes err as s3 xml error, errors without s3 code are internal errors
+func writeS3APIError(w http.ResponseWriter, req *http.Request, err error) {
+	if e, ok := err.(*S3APIError); ok {
+		writeS3Error(w, req, e.Status, e.Code, e.Message)
+		return
+	}
+	if e, ok := err.(*quotaError); ok {
+		writeS3Error(w, req, http.StatusInsufficientStorage, "QuotaExceeded", e.Error())
+		return
+	}
+	writeS3Error(w, req, http.StatusInternalServerError, "InternalError", err.Error())
+}
+
+type InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadId string   `xml:"UploadId"`
+}
+
+type CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+type S3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type S3Part struct {
+	PartNumber   int    `xml:"PartNumber"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+}
+
+type ListPartsResult struct {
+	XMLName              xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListPartsResult"`
+	Bucket               string   `xml:"Bucket"`
+	Key                  string   `xml:"Key"`
+	UploadId             string   `xml:"UploadId"`
+	Initiator            S3Owner  `xml:"Initiator"`
+	Owner                S3Owner  `xml:"Owner"`
+	StorageClass         string   `xml:"StorageClass"`
+	PartNumberMarker     int      `xml:"PartNumberMarker"`
+	NextPartNumberMarker int      `xml:"NextPartNumberMarker"`
+	MaxParts             int      `xml:"MaxParts"`
+	IsTruncated          bool     `xml:"IsTruncated"`
+	Parts                []S3Part `xml:"Part"`
+}
+
+type S3Upload struct {
+	Key          string  `xml:"Key"`
+	UploadId     string  `xml:"UploadId"`
+	Initiator    S3Owner `xml:"Initiator"`
+	Owner        S3Owner `xml:"Owner"`
+	StorageClass string  `xml:"StorageClass"`
+	Initiated    string  `xml:"Initiated"`
+}
+
+type S3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type ListMultipartUploadsResult struct {
+	XMLName            xml.Name         `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListMultipartUploadsResult"`
+	Bucket             string           `xml:"Bucket"`
+	KeyMarker          string           `xml:"KeyMarker"`
+	UploadIdMarker     string           `xml:"UploadIdMarker"`
+	NextKeyMarker      string           `xml:"NextKeyMarker"`
+	NextUploadIdMarker string           `xml:"NextUploadIdMarker"`
+	Prefix             string           `xml:"Prefix"`
+	Delimiter          string           `xml:"Delimiter,omitempty"`
+	MaxUploads         int              `xml:"MaxUploads"`
+	IsTruncated        bool             `xml:"IsTruncated"`
+	Uploads            []S3Upload       `xml:"Upload"`
+	CommonPrefixes     []S3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+type LocationConstraint struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LocationConstraint"`
+	Location string   `xml:",chardata"`
+}
+
+type S3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type ListAllMyBucketsResult struct {
+	XMLName xml.Name   `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+	Owner   S3Owner    `xml:"Owner"`
+	Buckets []S3Bucket `xml:"Buckets>Bucket"`
+}
+
+type CopyObjectResult struct {
+	XMLName      xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CopyObjectResult"`
+	LastModified string   `xml:"LastModified"`
+	ETag         string   `xml:"ETag"`
+}
+
+// S3Delete is the request body of DeleteObjects
+type S3Delete struct {
+	XMLName xml.Name `xml:"Delete"`
+	Quiet   bool     `xml:"Quiet"`
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+type S3Deleted struct {
+	Key string `xml:"Key"`
+}
+
+type S3DeleteError struct {
+	Key     string `xml:"Key"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type DeleteResult struct {
+	XMLName xml.Name        `xml:"http://s3.amazonaws.com/doc/2006-03-01/ DeleteResult"`
+	Deleted []S3Deleted     `xml:"Deleted"`
+	Errors  []S3DeleteError `xml:"Error"`
+}
+
+// s3MaxDeleteObjects is the max number of keys in one DeleteObjects request, same as s3
+const s3MaxDeleteObjects = 1000
+
+var reS3UserAgent = regexp.MustCompile("(Boto|aws-sdk-|aws-cli|S3Manager|MinIO)")
+
+// isS3Request reports whether the request comes from a s3 client and should be answered the s3 way.
+// Only works when s3 mode is enabled.
+func (s *HTTPStaticServer) isS3Request(req *http.Request) bool {
+	if !s.S3 {
+		return false
+	}
+	if strings.HasPrefix(req.Header.Get("Authorization"), "AWS") || req.URL.Query().Get("X-Amz-Algorithm") != "" {
+		return true
+	}
+	if req.Header.Get("X-Amz-Date") != "" || req.Header.Get("X-Amz-Content-Sha256") != "" {
+		return true
+	}
+	return reS3UserAgent.MatchString(req.Header.Get("User-Agent"))
+}
+
+// s3VirtualHostBucket returns the bucket of virtual-host style requests, eg: bucket.s3.example.com
+func (s *HTTPStaticServer) s3VirtualHostBucket(req *http.Request) string {
+	if !s.S3 || s.S3Domain == "" {
+		return ""
+	}
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if strings.HasSuffix(host, "."+s.S3Domain) {
+		return strings.TrimSuffix(host, "."+s.S3Domain)
+	}
+	return ""
+}
+
+// splitBucketKey splits request path into bucket and object key.
+// Buckets are directories directly under root, both path-style and virtual-host style
+// (which is rewritten to path-style in ServeHTTP) requests end up at root/bucket/key.
+func splitBucketKey(path string) (bucket, key string) {
+	path = strings.TrimLeft(filepath.ToSlash(path), "/")
+	parts := strings.SplitN(path, "/", 2)
+	bucket = parts[0]
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+	return
+}
+
+// s3RequestBody returns the object data of the request, aws-chunked bodies are decoded.
+// size is -1 if unknown.
+func s3RequestBody(req *http.Request) (body io.Reader, size int64) {
+	if strings.HasPrefix(req.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") ||
+		strings.Contains(req.Header.Get("Content-Encoding"), "aws-chunked") {
+		size = -1
+		if n, err := strconv.ParseInt(req.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64); err == nil {
+			size = n
+		}
+		return newAWSChunkedReader(req.Body, requestChunkVerifier(req)), size
+	}
+	return req.Body, req.ContentLength
+}
+
+// awsChunkedReader decodes aws-chunked encoding used by streaming uploads.
+//
+//	<hex size>[;chunk-signature=<sig>]\r\n<data>\r\n ... 0[;chunk-signature=<sig>]\r\n[<trailers>\r\n]\r\n
+//
+// Chunk signatures are checked when verifier is not nil.
+type awsChunkedReader struct {
+	r         *bufio.Reader
+	remaining int64
+	err       error
+
+	verifier  *s3ChunkVerifier
+	signature string
+	h         hash.Hash
+}
+
+func newAWSChunkedReader(r io.Reader, verifier *s3ChunkVerifier) *awsChunkedReader {
+	return &awsChunkedReader{r: bufio.NewReader(r), verifier: verifier, h: sha256.New()}
+}
+
+var errMalformedChunk = errors.New("malformed aws-chunked encoding")
+
+func (c *awsChunkedReader) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (c *awsChunkedReader) Read(p []byte) (n int, err error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.remaining == 0 {
+		line, err := c.readLine()
+		if err != nil {
+			c.err = err
+			return 0, err
+		}
+		fields := strings.SplitN(line, ";", 2)
+		size, err := strconv.ParseInt(strings.TrimSpace(fields[0]), 16, 64)
+		if err != nil || size < 0 {
+			c.err = errMalformedChunk
+			return 0, c.err
+		}
+		c.signature = ""
+		if len(fields) == 2 {
+			c.signature = strings.TrimPrefix(fields[1], "chunk-signature=")
+		}
+		c.h.Reset()
+		if size == 0 {
+			if !c.verifyChunk() {
+				return 0, c.err
+			}
+			// skip trailing headers, eg: x-amz-checksum-crc32
+			for {
+				line, err := c.readLine()
+				if err != nil || line == "" {
+					break
+				}
+			}
+			c.err = io.EOF
+			return 0, io.EOF
+		}
+		c.remaining = size
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err = c.r.Read(p)
+	c.remaining -= int64(n)
+	c.h.Write(p[:n])
+	if c.remaining == 0 && err == nil {
+		if line, lerr := c.readLine(); lerr != nil || line != "" {
+			c.err = errMalformedChunk
+		} else if !c.verifyChunk() {
+			// 签名不对，调用者会丢弃整个上传
+			return 0, c.err
+		}
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		c.err = err
+	}
+	return n, err
+}
+
+func (c *awsChunkedReader) verifyChunk() bool {
+	if c.verifier != nil && !c.verifier.verify(c.signature, c.h.Sum(nil)) {
+		c.err = errSignatureMismatch
+		return false
+	}
+	return true
+}
+
+type etagCacheItem struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+var (
+	etagCache   = make(map[string]etagCacheItem)
+	etagCacheMu sync.Mutex
+)
+
+// setFileETag remembers etag of a file just written, eg: composite etag of multipart uploads
+func setFileETag(path string, etag string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	etagCacheMu.Lock()
+	etagCache[path] = etagCacheItem{info.Size(), info.ModTime(), etag}
+	etagCacheMu.Unlock()
+}
+
+// fileETag returns md5 of the file without quotes, it is cached until the file is modified
+func fileETag(path string, info os.FileInfo) (string, error) {
+	etagCacheMu.Lock()
+	item, ok := etagCache[path]
+	etagCacheMu.Unlock()
+	if ok && item.size == info.Size() && item.modTime.Equal(info.ModTime()) {
+		return item.etag, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	etag := fmt.Sprintf("%x", h.Sum(nil))
+	etagCacheMu.Lock()
+	etagCache[path] = etagCacheItem{info.Size(), info.ModTime(), etag}
+	etagCacheMu.Unlock()
+	return etag, nil
+}
+
+// listETag is the etag used in object listings, it never reads the file:
+// a known md5 or composite etag is reused, otherwise it is made of mtime and size
+func listETag(path string, info os.FileInfo) string {
+	etagCacheMu.Lock()
+	item, ok := etagCache[path]
+	etagCacheMu.Unlock()
+	if ok && item.size == info.Size() && item.modTime.Equal(info.ModTime()) {
+		return item.etag
+	}
+	return fmt.Sprintf("%x-%x", info.ModTime().UnixNano(), info.Size())
+}
+
+// hS3Get handles GetObject, HeadObject, HeadBucket, GetBucketLocation and ListBuckets
+func (s *HTTPStaticServer) hS3Get(w http.ResponseWriter, req *http.Request) {
+	path := mux.Vars(req)["path"]
+	bucket, key := splitBucketKey(path)
+	if bucket == "" {
+		s.hS3ListBuckets(w, req)
+		return
+	}
+	if isTempFile(bucket) || !isDir(filepath.Join(s.Root, bucket)) {
+		writeS3Error(w, req, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.")
+		return
+	}
+	if key == "" {
+		if _, ok := req.URL.Query()["location"]; ok {
+			location := s.S3Region
+			if location == "us-east-1" {
+				location = ""
+			}
+			writeS3XML(w, http.StatusOK, LocationConstraint{Location: location})
+			return
+		}
+		if req.Method == "HEAD" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		s.hS3ListObjects(w, req)
+		return
+	}
+
+	// s3没有目录的概念，目录和临时文件都当作不存在
+	localPath := filepath.Join(s.Root, path)
+	info, err := os.Stat(localPath)
+	if err != nil || !info.Mode().IsRegular() || isInternalFile(localPath) {
+		writeS3Error(w, req, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	auth := s.readAccessConf(path)
+	if !auth.canAccess(info.Name()) || (info.Name() == YAMLCONF && !auth.Delete) {
+		writeS3Error(w, req, http.StatusForbidden, "AccessDenied", "Access Denied")
+		return
+	}
+
+	etag, err := fileETag(localPath, info)
+	if err != nil {
+		writeS3APIError(w, req, err)
+		return
+	}
+	f, err := os.Open(localPath)
+	if err != nil {
+		writeS3APIError(w, req, err)
+		return
+	}
+	defer f.Close()
+
+	if meta := getFileMeta(localPath, info); meta != nil {
+		meta.setHeaders(w.Header())
+	}
+	w.Header().Set("ETag", strconv.Quote(etag))
+	w.Header().Set("Accept-Ranges", "bytes")
+	http.ServeContent(w, req, info.Name(), info.ModTime(), f)
+}
+
+func (s *HTTPStaticServer) hS3ListBuckets(w http.ResponseWriter, req *http.Request) {
+	finfos, err := ioutil.ReadDir(s.Root)
+	if err != nil {
+		writeS3APIError(w, req, err)
+		return
+	}
+	auth := s.readAccessConf("/")
+	result := ListAllMyBucketsResult{
+		Owner:   multipartOwnerXML(multipartOwner(req)),
+		Buckets: make([]S3Bucket, 0),
+	}
+	for _, fi := range finfos {
+		if !fi.IsDir() || !auth.canAccess(fi.Name()) || isInternalFile(fi.Name()) {
+			continue
+		}
+		result.Buckets = append(result.Buckets, S3Bucket{
+			Name:         fi.Name(),
+			CreationDate: fi.ModTime().UTC().Format(s3TimeFormat),
+		})
+	}
+	writeS3XML(w, http.StatusOK, result)
+}
+
+// hS3Put handles PutObject and CreateBucket
+func (s *HTTPStaticServer) hS3Put(w http.ResponseWriter, req *http.Request) {
+	path := mux.Vars(req)["path"]
+	bucket, key := splitBucketKey(path)
+	if bucket == "" || checkFilename(bucket) != nil {
+		writeS3Error(w, req, http.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid.")
+		return
+	}
+	auth := s.readAccessConf(path)
+	if !auth.canUpload(req) {
+		writeS3Error(w, req, http.StatusForbidden, "AccessDenied", "Access Denied")
+		return
+	}
+	// 中间的每一级目录都要检查，不能写到.ghs-versions这类内部目录里
+	if err := checkRelativePath(multipartKey(path)); err != nil {
+		writeS3Error(w, req, http.StatusBadRequest, "InvalidArgument", err.Error())
+		return
+	}
+
+	// key以/结尾是s3客户端创建的"目录"，直接建目录
+	localPath := filepath.Join(s.Root, path)
+	if key == "" || strings.HasSuffix(key, "/") {
+		if err := os.MkdirAll(localPath, os.ModePerm); err != nil {
+			writeS3APIError(w, req, err)
+			return
+		}
+		if key == "" {
+			w.Header().Set("Location", "/"+bucket)
+		} else {
+			w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`) // md5 of empty content
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err := auth.checkExtension(localPath); err != nil {
+		writeS3APIError(w, req, err)
+		return
+	}
+	if source := req.Header.Get("X-Amz-Copy-Source"); source != "" {
+		s.hS3CopyObject(w, req, source)
+		return
+	}
+	meta, err := fileMetaFromRequest(req, req.Header.Get("Content-Type"))
+	if err != nil {
+		writeS3Error(w, req, http.StatusBadRequest, "MetadataTooLarge", err.Error())
+		return
+	}
+	body, size := s3RequestBody(req)
+	if err := auth.checkFileSize(size); err != nil {
+		writeS3APIError(w, req, err)
+		return
+	}
+	if err := s.checkQuotaSize(auth, localPath, size); err != nil {
+		writeS3APIError(w, req, err)
+		return
+	}
+
+	var contentMD5 []byte
+	if value := req.Header.Get("Content-MD5"); value != "" {
+		var err error
+		contentMD5, err = base64.StdEncoding.DecodeString(value)
+		if err != nil || len(contentMD5) != md5.Size {
+			writeS3Error(w, req, http.StatusBadRequest, "InvalidDigest", "The Content-MD5 you specified was invalid.")
+			return
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(localPath), os.ModePerm); err != nil {
+		writeS3APIError(w, req, err)
+		return
+	}
+	if isDir(localPath) {
+		writeS3Error(w, req, http.StatusConflict, "InvalidRequest", "A directory with the same name exists.")
+		return
+	}
+	dst, err := CreatePendingFile(localPath)
+	if err != nil {
+		writeS3APIError(w, req, err)
+		return
+	}
+	defer dst.Abort()
+
+	h := md5.New()
+	if _, err := io.Copy(io.MultiWriter(dst, h), auth.limitReader(body)); err != nil {
+		log.Println("Handle upload file:", err)
+		w.Header().Set("Connection", "close")
+		if _, ok := err.(*S3APIError); ok {
+			writeS3APIError(w, req, err)
+			return
+		}
+		writeS3Error(w, req, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	sum := h.Sum(nil)
+	if contentMD5 != nil && !bytes.Equal(sum, contentMD5) {
+		writeS3Error(w, req, http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received.")
+		return
+	}
+	if err := auth.checkUploadedFile(dst.File); err != nil {
+		writeS3APIError(w, req, err)
+		return
+	}
+	usedSize, usedFiles, err := s.checkQuotaFile(auth, dst.File, localPath)
+	if err != nil {
+		writeS3APIError(w, req, err)
+		return
+	}
+	if _, err := s.archiveVersion(auth, localPath); err != nil {
+		writeS3APIError(w, req, err)
+		return
+	}
+	if err := dst.Commit(); err != nil {
+		writeS3APIError(w, req, err)
+		return
+	}
+	s.addQuotaUsage(auth, usedSize, usedFiles)
+	etag := fmt.Sprintf("%x", sum)
+	setFileETag(localPath, etag)
+	setFileMeta(localPath, meta)
+
+	w.Header().Set("ETag", strconv.Quote(etag))
+	w.WriteHeader(http.StatusOK)
+}
+
+// hS3Delete handles DeleteObject and DeleteBucket
+func (s *HTTPStaticServer) hS3Delete(w http.ResponseWriter, req *http.Request) {
+	path := mux.Vars(req)["path"]
+	bucket, key := splitBucketKey(path)
+	if bucket == "" {
+		writeS3Error(w, req, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
+		return
+	}
+	if isTrashPath(path) || isVersionPath(path) {
+		writeS3Error(w, req, http.StatusForbidden, "AccessDenied", "Access Denied")
+		return
+	}
+	auth := s.readAccessConf(path)
+	if !auth.canDelete(req) {
+		writeS3Error(w, req, http.StatusForbidden, "AccessDenied", "Access Denied")
+		return
+	}
+
+	localPath := filepath.Join(s.Root, path)
+	info, err := os.Stat(localPath)
+	if key == "" {
+		if err != nil || !info.IsDir() {
+			writeS3Error(w, req, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.")
+			return
+		}
+		if err := os.Remove(localPath); err != nil {
+			writeS3Error(w, req, http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty.")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if err := s.s3DeleteObject(req, path); err != nil {
+		writeS3APIError(w, req, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// s3DeleteObject removes the file of an object at path the same way as other deletes,
+// it goes to the trash or the version store if enabled.
+// 删除不存在的key也返回成功，和s3一致；目录只在为空时删除
+func (s *HTTPStaticServer) s3DeleteObject(req *http.Request, path string) error {
+	localPath := filepath.Join(s.Root, path)
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return nil
+	}
+	if info.IsDir() {
+		os.Remove(localPath)
+		return nil
+	}
+	return s.deletePath(req, path)
+}
+
+// hS3CopyObject handles PutObject with x-amz-copy-source, the file is copied on server side.
+// The source needs to be readable and the destination uploadable, same as a download plus an upload.
+func (s *HTTPStaticServer) hS3CopyObject(w http.ResponseWriter, req *http.Request, source string) {
+	// x-amz-copy-source: /bucket/key?versionId=xxx, url encoded
+	if idx := strings.Index(source, "?"); idx >= 0 {
+		source = source[:idx]
+	}
+	srcPath, err := url.PathUnescape(source)
+	if err != nil || !IsSafePath(srcPath) {
+		writeS3Error(w, req, http.StatusBadRequest, "InvalidArgument", "Copy Source must mention the source bucket and key: sourcebucket/sourcekey.")
+		return
+	}
+	// 不能只靠IsSafePath，拼到Root之前先规范化，..不会跑到Root外面
+	srcPath = multipartKey(srcPath)
+	srcBucket, srcKey := splitBucketKey(srcPath)
+	if srcBucket == "" || srcKey == "" {
+		writeS3Error(w, req, http.StatusBadRequest, "InvalidArgument", "Copy Source must mention the source bucket and key: sourcebucket/sourcekey.")
+		return
+	}
+	// 回收站和历史版本都是内部数据，不能被复制出来
+	if isTrashPath(srcPath) || isVersionPath(srcPath) {
+		writeS3Error(w, req, http.StatusForbidden, "AccessDenied", "Access Denied")
+		return
+	}
+	srcLocal := filepath.Join(s.Root, srcPath)
+	info, err := os.Stat(srcLocal)
+	if err != nil || !info.Mode().IsRegular() || isInternalFile(srcLocal) {
+		writeS3Error(w, req, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	srcAuth := s.readAccessConf(srcPath)
+	if !srcAuth.canAccess(info.Name()) || (isReadProtected(srcPath) && !srcAuth.canDelete(req)) {
+		writeS3Error(w, req, http.StatusForbidden, "AccessDenied", "Access Denied")
+		return
+	}
+
+	// x-amz-metadata-directive: COPY(default) keeps metadata of the source, REPLACE takes it from the request
+	meta, err := fileMetaFromRequest(req, req.Header.Get("Content-Type"))
+	if err != nil {
+		writeS3Error(w, req, http.StatusBadRequest, "MetadataTooLarge", err.Error())
+		return
+	}
+	replaceMeta := strings.EqualFold(req.Header.Get("X-Amz-Metadata-Directive"), "REPLACE")
+	if !replaceMeta {
+		if srcMeta := getFileMeta(srcLocal, info); srcMeta != nil {
+			meta.ContentType = srcMeta.ContentType
+			meta.Metadata = srcMeta.Metadata
+		} else {
+			meta.ContentType, meta.Metadata = "", nil
+		}
+	}
+
+	path := mux.Vars(req)["path"]
+	localPath := filepath.Join(s.Root, path)
+	if filepath.Clean(localPath) == filepath.Clean(srcLocal) && !replaceMeta {
+		writeS3Error(w, req, http.StatusBadRequest, "InvalidRequest", "This copy request is illegal because it is trying to copy an object to itself without changing the object's metadata.")
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(localPath), os.ModePerm); err != nil {
+		writeS3APIError(w, req, err)
+		return
+	}
+	if isDir(localPath) {
+		writeS3Error(w, req, http.StatusConflict, "InvalidRequest", "A directory with the same name exists.")
+		return
+	}
+
+	src, err := os.Open(srcLocal)
+	if err != nil {
+		writeS3APIError(w, req, err)
+		return
+	}
+	defer src.Close()
+	dst, err := CreatePendingFile(localPath)
+	if err != nil {
+		writeS3APIError(w, req, err)
+		return
+	}
+	defer dst.Abort()
+	h := md5.New()
+	if _, err := io.Copy(io.MultiWriter(dst, h), src); err != nil {
+		writeS3APIError(w, req, err)
+		return
+	}
+	dstAuth := s.readAccessConf(path)
+	if err := dstAuth.checkUploadedFile(dst.File); err != nil {
+		writeS3APIError(w, req, err)
+		return
+	}
+	usedSize, usedFiles, err := s.checkQuotaFile(dstAuth, dst.File, localPath)
+	if err != nil {
+		writeS3APIError(w, req, err)
+		return
+	}
+	if _, err := s.archiveVersion(dstAuth, localPath); err != nil {
+		writeS3APIError(w, req, err)
+		return
+	}
+	if err := dst.Commit(); err != nil {
+		writeS3APIError(w, req, err)
+		return
+	}
+	s.addQuotaUsage(dstAuth, usedSize, usedFiles)
+	etag := fmt.Sprintf("%x", h.Sum(nil))
+	setFileETag(localPath, etag)
+	setFileMeta(localPath, meta)
+
+	modTime := time.Now()
+	if fi, err := os.Stat(localPath); err == nil {
+		modTime = fi.ModTime()
+	}
+	writeS3XML(w, http.StatusOK, CopyObjectResult{
+		LastModified: modTime.UTC().Format(s3TimeFormat),
+		ETag:         strconv.Quote(etag),
+	})
+}
+
+// hS3DeleteObjects handles POST /bucket?delete, every key is checked and deleted like DeleteObject
+func (s *HTTPStaticServer) hS3DeleteObjects(w http.ResponseWriter, req *http.Request) {
+	bucket, key := splitBucketKey(mux.Vars(req)["path"])
+	if bucket == "" || key != "" {
+		writeS3Error(w, req, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
+		return
+	}
+	if !isDir(filepath.Join(s.Root, bucket)) {
+		writeS3Error(w, req, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.")
+		return
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(req.Body, 2<<20))
+	if err != nil {
+		writeS3Error(w, req, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	if value := req.Header.Get("Content-MD5"); value != "" {
+		sum := md5.Sum(data)
+		if value != base64.StdEncoding.EncodeToString(sum[:]) {
+			writeS3Error(w, req, http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received.")
+			return
+		}
+	}
+	var body S3Delete
+	if err := xml.Unmarshal(data, &body); err != nil || len(body.Objects) == 0 || len(body.Objects) > s3MaxDeleteObjects {
+		writeS3Error(w, req, http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema.")
+		return
+	}
+
+	result := DeleteResult{}
+	accessConfs := make(map[string]AccessConf)
+	for _, obj := range body.Objects {
+		path := bucket + "/" + obj.Key
+		if obj.Key == "" || !IsSafePath(path) {
+			result.Errors = append(result.Errors, S3DeleteError{obj.Key, "InvalidArgument", "Invalid key."})
+			continue
+		}
+		if isTrashPath(path) || isVersionPath(path) {
+			result.Errors = append(result.Errors, S3DeleteError{obj.Key, "AccessDenied", "Access Denied"})
+			continue
+		}
+		dir := filepath.Dir(path)
+		auth, ok := accessConfs[dir]
+		if !ok {
+			auth = s.readAccessConf(dir)
+			accessConfs[dir] = auth
+		}
+		if !auth.canDelete(req) {
+			result.Errors = append(result.Errors, S3DeleteError{obj.Key, "AccessDenied", "Access Denied"})
+			continue
+		}
+		if err := s.s3DeleteObject(req, path); err != nil {
+			if e, ok := err.(*S3APIError); ok {
+				result.Errors = append(result.Errors, S3DeleteError{obj.Key, e.Code, e.Message})
+			} else {
+				result.Errors = append(result.Errors, S3DeleteError{obj.Key, "InternalError", err.Error()})
+			}
+			continue
+		}
+		if !body.Quiet {
+			result.Deleted = append(result.Deleted, S3Deleted{obj.Key})
+		}
+	}
+	writeS3XML(w, http.StatusOK, result)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newS3Request is an unsigned request of an s3 client
+func newS3Request(method, target string, body io.Reader) *http.Request {
+	req := newTestRequest(method, target, body)
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	return req
+}
+
+func TestS3Object(t *testing.T) {
+	s := newTestServer(t, map[string]string{"bkt/": ""})
+	s.S3 = true
+
+	w := serveTest(s.hUploadOrMkdir, newS3Request("PUT", "/bkt/dir/a.txt", strings.NewReader("hello")))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"5d41402abc4b2a76b9719d911017c592"`, w.Header().Get("ETag"))
+
+	w = serveTest(s.hIndex, newS3Request("GET", "/bkt/dir/a.txt", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "hello", w.Body.String())
+	assert.Equal(t, `"5d41402abc4b2a76b9719d911017c592"`, w.Header().Get("ETag"))
+	w = serveTest(s.hIndex, newS3Request("HEAD", "/bkt/dir/a.txt", nil))
+	assert.Equal(t, "5", w.Header().Get("Content-Length"))
+	w = serveTest(s.hIndex, newS3Request("GET", "/bkt/dir", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "NoSuchKey")
+	w = serveTest(s.hIndex, newS3Request("GET", "/nobkt/a.txt", nil))
+	assert.Contains(t, w.Body.String(), "NoSuchBucket")
+
+	// internal directories can not be written by any level of the key
+	for _, path := range []string{"/bkt/.ghs-versions/a.txt/20200102T030405.000000006Z", "/bkt/dir/.ghs-versions/a.txt", "/bkt/.ghs-meta.json"} {
+		w = serveTest(s.hUploadOrMkdir, newS3Request("PUT", path, strings.NewReader("forged")))
+		assert.Equal(t, http.StatusBadRequest, w.Code, path)
+		w = serveTest(s.hUploadOrMkdir, newS3Request("POST", path+"?uploads", nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code, path)
+	}
+	assert.False(t, testFileExists(s, "bkt/.ghs-versions"))
+
+	writeTestFiles(t, s, map[string]string{"bkt/.ghs-versions/a.txt/20200102T030405.000000006Z": "v1"})
+	w = serveTest(s.hDelete, newS3Request("DELETE", "/bkt/.ghs-versions/a.txt/20200102T030405.000000006Z", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.True(t, testFileExists(s, "bkt/.ghs-versions/a.txt/20200102T030405.000000006Z"))
+
+	w = serveTest(s.hDelete, newS3Request("DELETE", "/bkt/dir/a.txt", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.False(t, testFileExists(s, "bkt/dir/a.txt"))
+	// deleting a missing key succeeds as s3 does
+	w = serveTest(s.hDelete, newS3Request("DELETE", "/bkt/dir/a.txt", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
+
+func TestS3ListObjectsV2(t *testing.T) {
+	s := newTestServer(t, map[string]string{
+		"bkt/a.txt":                  "1",
+		"bkt/b/c.txt":                "22",
+		"bkt/b/d.txt":                "333",
+		"bkt/b/.ghs-versions/c.txt/": "",
+		"bkt/e.txt":                  "4444",
+		"bkt/" + YAMLCONF:            "upload: true\n",
+	})
+	s.S3 = true
+	list := func(query string) (int, ListBucketResult) {
+		w := serveTest(s.hIndex, newS3Request("GET", "/bkt?"+query, nil))
+		var result ListBucketResult
+		if w.Code == http.StatusOK {
+			assert.NoError(t, xml.Unmarshal(w.Body.Bytes(), &result))
+		}
+		return w.Code, result
+	}
+
+	// follow continuation tokens until the end
+	var keys []string
+	query := "list-type=2&max-keys=2"
+	for pages := 0; pages < 10; pages++ {
+		code, result := list(query)
+		assert.Equal(t, http.StatusOK, code)
+		assert.True(t, len(result.Contents) <= 2)
+		assert.Equal(t, len(result.Contents), *result.KeyCount)
+		for _, obj := range result.Contents {
+			keys = append(keys, obj.Key)
+		}
+		if !result.IsTruncated {
+			assert.Empty(t, result.NextContinuationToken)
+			break
+		}
+		query = "list-type=2&max-keys=2&continuation-token=" + url.QueryEscape(result.NextContinuationToken)
+	}
+	assert.Equal(t, []string{"a.txt", "b/c.txt", "b/d.txt", "e.txt"}, keys)
+
+	_, result := list("list-type=2&delimiter=/")
+	assert.Equal(t, []S3CommonPrefix{{"b/"}}, result.CommonPrefixes)
+	assert.Len(t, result.Contents, 2)
+	_, result = list("list-type=2&prefix=b/&start-after=b/c.txt")
+	if assert.Len(t, result.Contents, 1) {
+		assert.Equal(t, "b/d.txt", result.Contents[0].Key)
+		assert.Equal(t, int64(3), result.Contents[0].Size)
+	}
+	// ListObjects v1 uses markers
+	_, result = list("max-keys=1&marker=a.txt")
+	assert.True(t, result.IsTruncated)
+	assert.Equal(t, "b/c.txt", result.NextMarker)
+
+	code, _ := list("list-type=2&continuation-token=%21%21")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = list("list-type=2&max-keys=-1")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestS3ListObjectsKeyOrder(t *testing.T) {
+	// b.txt sorts before b/c.txt although the directory b is walked first by name
+	s := newTestServer(t, map[string]string{
+		"bkt/b/c.txt": "1",
+		"bkt/b.txt":   "22",
+		"bkt/b-c.txt": "333",
+	})
+	s.S3 = true
+	var keys []string
+	marker := ""
+	for pages := 0; pages < 10; pages++ {
+		w := serveTest(s.hIndex, newS3Request("GET", "/bkt?max-keys=1&marker="+url.QueryEscape(marker), nil))
+		var result ListBucketResult
+		assert.NoError(t, xml.Unmarshal(w.Body.Bytes(), &result))
+		for _, obj := range result.Contents {
+			keys = append(keys, obj.Key)
+			// listings never read the file, md5 is only used once it is known
+			assert.NotEqual(t, `"c4ca4238a0b923820dcc509a6f75849b"`, obj.ETag)
+		}
+		if !result.IsTruncated {
+			break
+		}
+		marker = result.NextMarker
+	}
+	assert.Equal(t, []string{"b-c.txt", "b.txt", "b/c.txt"}, keys)
+
+	w := serveTest(s.hIndex, newS3Request("HEAD", "/bkt/b/c.txt", nil))
+	assert.Equal(t, `"c4ca4238a0b923820dcc509a6f75849b"`, w.Header().Get("ETag"))
+	w = serveTest(s.hIndex, newS3Request("GET", "/bkt?prefix=b/", nil))
+	assert.Contains(t, w.Body.String(), "&#34;c4ca4238a0b923820dcc509a6f75849b&#34;")
+}
+
+func TestS3CopyObject(t *testing.T) {
+	s := newTestServer(t, map[string]string{
+		"bkt/a.txt":                  "hello",
+		"bkt/.ghs-versions/a.txt/v1": "old",
+		"bkt/" + YAMLCONF:            "upload: true\nusers:\n- token: secret\n",
+		"bkt/sub/" + metaFileName:    "{}",
+		".ghs-trash/1/info.json":     "{}",
+	})
+	s.S3 = true
+	s.Delete = false
+	copyObject := func(source, dst string) int {
+		req := newS3Request("PUT", dst, nil)
+		req.Header.Set("X-Amz-Copy-Source", source)
+		return serveTest(s.hUploadOrMkdir, req).Code
+	}
+
+	assert.Equal(t, http.StatusOK, copyObject("/bkt/a.txt", "/bkt/b.txt"))
+	assert.Equal(t, "hello", readTestFile(s, "bkt/b.txt"))
+
+	for _, source := range []string{"/bkt/..", "bkt/a.txt/..", "bkt/sub/../a.txt", "../bkt/a.txt"} {
+		assert.Equal(t, http.StatusBadRequest, copyObject(source, "/bkt/d.txt"), source)
+	}
+	for _, source := range []string{
+		"/bkt/.ghs-versions/a.txt/v1",
+		"/.ghs-trash/1/info.json",
+		"/bkt/" + YAMLCONF,
+		"/bkt/sub/" + metaFileName,
+	} {
+		code := copyObject(source, "/bkt/d.txt")
+		assert.True(t, code == http.StatusForbidden || code == http.StatusNotFound, source)
+	}
+	assert.False(t, testFileExists(s, "bkt/d.txt"))
+}
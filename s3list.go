@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+type S3Object struct {
+	Key          string   `xml:"Key"`
+	LastModified string   `xml:"LastModified"`
+	ETag         string   `xml:"ETag"`
+	Size         int64    `xml:"Size"`
+	StorageClass string   `xml:"StorageClass"`
+	Owner        *S3Owner `xml:"Owner,omitempty"`
+}
+
+// ListBucketResult is the response of both ListObjects and ListObjectsV2
+type ListBucketResult struct {
+	XMLName               xml.Name         `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	EncodingType          string           `xml:"EncodingType,omitempty"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	Marker                *string          `xml:"Marker"`
+	NextMarker            string           `xml:"NextMarker,omitempty"`
+	KeyCount              *int             `xml:"KeyCount"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	Contents              []S3Object       `xml:"Contents"`
+	CommonPrefixes        []S3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+type s3ListEntry struct {
+	Key  string
+	Info os.FileInfo // nil for common prefixes
+	Dir  string      // directory relative to root
+}
+
+// s3URLEncode encodes keys for encoding-type=url, clients decode them with query unescape
+func s3URLEncode(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// errListFull stops walkKeys once enough keys are found
+var errListFull = errors.New("list is full")
+
+// s3KeyName is the name of a directory entry as it sorts in keys, directories end with a slash
+func s3KeyName(info os.FileInfo) string {
+	if info.IsDir() {
+		return info.Name() + "/"
+	}
+	return info.Name()
+}
+
+// walkKeys walks like walkTree, but entries of a directory are visited in the order of their keys
+// (a/b sorts after a.txt), so the whole walk yields keys in order and can stop early
+func (s *HTTPStaticServer) walkKeys(path string, info os.FileInfo, fn func(path string, info os.FileInfo) error) error {
+	relPath, _ := filepath.Rel(s.Root, path)
+	if err := fn(filepath.ToSlash(relPath), info); err != nil {
+		if err == filepath.SkipDir && info.IsDir() {
+			return nil
+		}
+		return err
+	}
+	if !info.IsDir() {
+		return nil
+	}
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		log.Printf("WARN: Visit path: %s error: %v", strconv.Quote(path), err)
+		return nil
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return s3KeyName(infos[i]) < s3KeyName(infos[j])
+	})
+	for _, fi := range infos {
+		if isInternalFile(fi.Name()) {
+			continue
+		}
+		if err := s.walkKeys(filepath.Join(path, fi.Name()), fi, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listBucket returns objects and common prefixes in bucket which are after the given key, ordered by key.
+// Only the deepest directory covering prefix is walked, and directories whose keys are all
+// rolled up into one common prefix or are all before after are skipped.
+// The walk stops once more than limit entries are found, so that IsTruncated is still known.
+func (s *HTTPStaticServer) listBucket(bucket, prefix, delimiter, after string, limit int) ([]s3ListEntry, error) {
+	walkDir := filepath.Join(s.Root, bucket)
+	if idx := strings.LastIndex(prefix, "/"); idx >= 0 {
+		walkDir = filepath.Join(walkDir, prefix[:idx])
+	}
+	walkInfo, err := os.Lstat(walkDir)
+	if err != nil || !walkInfo.IsDir() {
+		return nil, nil
+	}
+
+	entries := make([]s3ListEntry, 0)
+	seenPrefixes := make(map[string]bool)
+	addPrefix := func(commonPrefix string) {
+		if commonPrefix > after && !seenPrefixes[commonPrefix] {
+			seenPrefixes[commonPrefix] = true
+			entries = append(entries, s3ListEntry{Key: commonPrefix})
+		}
+	}
+	accessConfs := make(map[string]AccessConf)
+
+	err = s.walkKeys(walkDir, walkInfo, func(path string, info os.FileInfo) error {
+		if len(entries) > limit {
+			return errListFull
+		}
+		if path == bucket {
+			return nil
+		}
+		key := strings.TrimPrefix(path, bucket+"/")
+		if info.IsDir() {
+			dirKey := key + "/"
+			if !strings.HasPrefix(dirKey, prefix) && !strings.HasPrefix(prefix, dirKey) {
+				return filepath.SkipDir
+			}
+			if dirKey < after && !strings.HasPrefix(after, dirKey) {
+				return filepath.SkipDir
+			}
+			if delimiter != "" && strings.HasPrefix(dirKey, prefix) {
+				if idx := strings.Index(dirKey[len(prefix):], delimiter); idx >= 0 {
+					addPrefix(dirKey[:len(prefix)+idx+len(delimiter)])
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+		if !strings.HasPrefix(key, prefix) || key <= after || info.Name() == YAMLCONF {
+			return nil
+		}
+		dir := filepath.Dir(path)
+		auth, ok := accessConfs[dir]
+		if !ok {
+			auth = s.readAccessConf(dir)
+			accessConfs[dir] = auth
+		}
+		if !auth.canAccess(info.Name()) {
+			return nil
+		}
+		if delimiter != "" {
+			if idx := strings.Index(key[len(prefix):], delimiter); idx >= 0 {
+				addPrefix(key[:len(prefix)+idx+len(delimiter)])
+				return nil
+			}
+		}
+		entries = append(entries, s3ListEntry{Key: key, Info: info, Dir: dir})
+		return nil
+	})
+	if err == errListFull {
+		err = nil
+	}
+	return entries, err
+}
+
+// hS3ListObjects handles ListObjects and ListObjectsV2 (list-type=2)
+func (s *HTTPStaticServer) hS3ListObjects(w http.ResponseWriter, req *http.Request) {
+	bucket, _ := splitBucketKey(mux.Vars(req)["path"])
+	query := req.URL.Query()
+	v2 := query.Get("list-type") == "2"
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	encodeURL := query.Get("encoding-type") == "url"
+	maxKeys, ok := parseMaxItems(query.Get("max-keys"))
+	if !ok {
+		writeS3Error(w, req, http.StatusBadRequest, "InvalidArgument", "Invalid max-keys.")
+		return
+	}
+
+	var after string
+	if v2 {
+		after = query.Get("start-after")
+		if token := query.Get("continuation-token"); token != "" {
+			data, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				writeS3Error(w, req, http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect.")
+				return
+			}
+			after = string(data)
+		}
+	} else {
+		after = query.Get("marker")
+	}
+
+	entries, err := s.listBucket(bucket, prefix, delimiter, after, maxKeys)
+	if err != nil {
+		writeS3APIError(w, req, err)
+		return
+	}
+
+	encode := func(s string) string {
+		if encodeURL {
+			return s3URLEncode(s)
+		}
+		return s
+	}
+	result := ListBucketResult{
+		Name:      bucket,
+		Prefix:    encode(prefix),
+		Delimiter: encode(delimiter),
+		MaxKeys:   maxKeys,
+		Contents:  make([]S3Object, 0),
+	}
+	if encodeURL {
+		result.EncodingType = "url"
+	}
+	var owner *S3Owner
+	if !v2 || query.Get("fetch-owner") == "true" {
+		o := multipartOwnerXML("")
+		owner = &o
+	}
+
+	var lastKey string
+	for _, entry := range entries {
+		if len(result.Contents)+len(result.CommonPrefixes) >= maxKeys {
+			result.IsTruncated = true
+			break
+		}
+		lastKey = entry.Key
+		if entry.Info == nil {
+			result.CommonPrefixes = append(result.CommonPrefixes, S3CommonPrefix{encode(entry.Key)})
+			continue
+		}
+		etag := listETag(filepath.Join(s.Root, entry.Dir, entry.Info.Name()), entry.Info)
+		result.Contents = append(result.Contents, S3Object{
+			Key:          encode(entry.Key),
+			LastModified: entry.Info.ModTime().UTC().Format(s3TimeFormat),
+			ETag:         strconv.Quote(etag),
+			Size:         entry.Info.Size(),
+			StorageClass: "STANDARD",
+			Owner:        owner,
+		})
+	}
+
+	if v2 {
+		keyCount := len(result.Contents) + len(result.CommonPrefixes)
+		result.KeyCount = &keyCount
+		result.ContinuationToken = query.Get("continuation-token")
+		result.StartAfter = encode(query.Get("start-after"))
+		if result.IsTruncated {
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(lastKey))
+		}
+	} else {
+		marker := encode(after)
+		result.Marker = &marker
+		if result.IsTruncated {
+			result.NextMarker = encode(lastKey)
+		}
+	}
+	writeS3XML(w, http.StatusOK, result)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// tempFilePrefix marks files still being written, they are hidden from file list and search
+const tempFilePrefix = ".ghs-tmp-"
+
+func isTempFile(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), tempFilePrefix)
+}
+
+// PendingFile is a temp file created in the same directory as its destination.
+// Nothing is visible at the destination until Commit renames it into place,
+// so readers never see a half written file and a failed write keeps the old one.
+type PendingFile struct {
+	*os.File
+	dst  string
+	done bool
+}
+
+func CreatePendingFile(dst string) (*PendingFile, error) {
+	f, err := ioutil.TempFile(filepath.Dir(dst), tempFilePrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	return &PendingFile{File: f, dst: dst}, nil
+}
+
+// Commit flushes the data to disk and renames the temp file over the destination
+func (p *PendingFile) Commit() error {
+	if p.done {
+		return os.ErrClosed
+	}
+	p.done = true
+	err := p.Sync()
+	if err == nil {
+		err = p.Chmod(0644) // TempFile creates files with 0600
+	}
+	if cerr := p.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(p.Name(), p.dst)
+	}
+	if err != nil {
+		os.Remove(p.Name())
+		return err
+	}
+	// make the rename itself durable
+	if dir, err := os.Open(filepath.Dir(p.dst)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// CommitAs commits to another destination in the same directory, eg: a renamed one when the original exists
+func (p *PendingFile) CommitAs(dst string) error {
+	p.dst = dst
+	return p.Commit()
+}
+
+// CommitNew commits to dst only if nothing is there, with a hard link which fails if dst exists instead of replacing it.
+// On an os.IsExist error the temp file is kept, so it can be committed to another name.
+func (p *PendingFile) CommitNew(dst string) error {
+	if p.done {
+		return os.ErrClosed
+	}
+	err := p.Sync()
+	if err == nil {
+		err = p.Chmod(0644)
+	}
+	if err == nil {
+		err = os.Link(p.Name(), dst)
+	}
+	if os.IsExist(err) {
+		return err
+	}
+	if err != nil {
+		// 不支持硬链接的文件系统退回到rename，调用方要持有路径锁
+		if _, serr := os.Lstat(dst); serr == nil {
+			return os.ErrExist
+		}
+		return p.CommitAs(dst)
+	}
+	p.dst = dst
+	p.done = true
+	p.Close()
+	os.Remove(p.Name())
+	if dir, err := os.Open(filepath.Dir(p.dst)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// Abort discards the temp file, it is a no-op after Commit
+func (p *PendingFile) Abort() {
+	if p.done {
+		return
+	}
+	p.done = true
+	p.Close()
+	os.Remove(p.Name())
+}
+
+// keyedMutex serializes operations on the same key, eg: the same destination path
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+// Lock blocks until key is free, the returned function releases it
+func (m *keyedMutex) Lock(key string) (unlock func()) {
+	m.mu.Lock()
+	if m.locks == nil {
+		m.locks = make(map[string]*keyedLock)
+	}
+	l, ok := m.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		m.locks[key] = l
+	}
+	l.refs++
+	m.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		m.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(m.locks, key)
+		}
+		m.mu.Unlock()
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// assertNoTempFiles checks no temp file of PendingFile is left in dir
+func assertNoTempFiles(t *testing.T, dir string) {
+	t.Helper()
+	finfos, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	for _, fi := range finfos {
+		assert.False(t, isTempFile(fi.Name()), fi.Name())
+	}
+}
+
+func TestPendingFile(t *testing.T) {
+	s := newTestServer(t, map[string]string{"a.txt": "old"})
+	dst := filepath.Join(s.Root, "a.txt")
+
+	f, err := CreatePendingFile(dst)
+	assert.NoError(t, err)
+	f.Write([]byte("new"))
+	assert.Equal(t, "old", readTestFile(s, "a.txt"))
+	f.Abort()
+	assert.Equal(t, "old", readTestFile(s, "a.txt"))
+	assertNoTempFiles(t, s.Root)
+
+	f, err = CreatePendingFile(dst)
+	assert.NoError(t, err)
+	f.Write([]byte("new"))
+	assert.NoError(t, f.Commit())
+	f.Abort() // no-op after Commit
+	assert.Equal(t, "new", readTestFile(s, "a.txt"))
+	assert.Equal(t, "-rw-r--r--", statTestFile(t, dst).Mode().Perm().String())
+	assert.Error(t, f.Commit())
+
+	f, err = CreatePendingFile(dst)
+	assert.NoError(t, err)
+	f.Write([]byte("renamed"))
+	assert.NoError(t, f.CommitAs(filepath.Join(s.Root, "b.txt")))
+	assert.Equal(t, "new", readTestFile(s, "a.txt"))
+	assert.Equal(t, "renamed", readTestFile(s, "b.txt"))
+	assertNoTempFiles(t, s.Root)
+}
+
+func TestPendingFileCommitNew(t *testing.T) {
+	s := newTestServer(t, map[string]string{"a.txt": "old"})
+
+	f, err := CreatePendingFile(filepath.Join(s.Root, "a.txt"))
+	assert.NoError(t, err)
+	f.Write([]byte("new"))
+	err = f.CommitNew(filepath.Join(s.Root, "a.txt"))
+	assert.True(t, os.IsExist(err))
+	assert.Equal(t, "old", readTestFile(s, "a.txt"))
+
+	// kept for another name
+	assert.NoError(t, f.CommitNew(filepath.Join(s.Root, "b.txt")))
+	assert.Equal(t, "new", readTestFile(s, "b.txt"))
+	assert.Equal(t, "-rw-r--r--", statTestFile(t, filepath.Join(s.Root, "b.txt")).Mode().Perm().String())
+	assert.Error(t, f.CommitNew(filepath.Join(s.Root, "c.txt")))
+	assertNoTempFiles(t, s.Root)
+}
+
+func TestKeyedMutex(t *testing.T) {
+	var m keyedMutex
+	var wg sync.WaitGroup
+	count := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := m.Lock("a")
+			defer unlock()
+			count++
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 50, count)
+	assert.Empty(t, m.locks)
+}
+
+// brokenReader returns data and then fails as a dropped connection
+type brokenReader struct {
+	data io.Reader
+}
+
+func (r *brokenReader) Read(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset by peer")
+	}
+	return n, err
+}
+
+func TestUploadKeepsOldFileOnFailure(t *testing.T) {
+	s := newTestServer(t, map[string]string{"dir/a.txt": "old"})
+	put := func(body io.Reader, size int, header map[string]string) int {
+		req := newTestRequest("PUT", "/dir/a.txt", body)
+		req.Header.Set("Content-Length", strconv.Itoa(size))
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		return serveTest(s.hUploadOrMkdir, req).Code
+	}
+
+	// interrupted in the middle
+	code := put(&brokenReader{strings.NewReader("new content")}, 20, nil)
+	assert.NotEqual(t, http.StatusOK, code)
+	assert.Equal(t, "old", readTestFile(s, "dir/a.txt"))
+	assertNoTempFiles(t, filepath.Join(s.Root, "dir"))
+
+	// rejected after written, Content-MD5 of "hello"
+	code = put(strings.NewReader("new"), 3, map[string]string{"Content-MD5": "XUFAKrxLKna5cZ2REBfFkg=="})
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "old", readTestFile(s, "dir/a.txt"))
+	assertNoTempFiles(t, filepath.Join(s.Root, "dir"))
+
+	code = put(strings.NewReader("new"), 3, nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "new", readTestFile(s, "dir/a.txt"))
+	assertNoTempFiles(t, filepath.Join(s.Root, "dir"))
+}
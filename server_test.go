@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// newTestServer returns a server allowing upload and delete on a temp root, which is removed after the test.
+// files are written by slash paths relative to root, names ending with / are directories.
+func newTestServer(t *testing.T, files map[string]string) *HTTPStaticServer {
+	t.Helper()
+	root, err := ioutil.TempDir("", "ghs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+	s := &HTTPStaticServer{
+		Root:         root,
+		Upload:       true,
+		Delete:       true,
+		StagingDir:   t.TempDir(),
+		MinPartSize:  5,
+		MaxPartSize:  5 << 20,
+		MaxPartCount: 100,
+	}
+	writeTestFiles(t, s, files)
+	s.makeIndex()
+	return s
+}
+
+func writeTestFiles(t *testing.T, s *HTTPStaticServer, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(s.Root, filepath.FromSlash(name))
+		if strings.HasSuffix(name, "/") {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readTestFile returns content of the file at slash path name, "" if it can not be read
+func readTestFile(s *HTTPStaticServer, name string) string {
+	data, _ := ioutil.ReadFile(filepath.Join(s.Root, filepath.FromSlash(name)))
+	return string(data)
+}
+
+func testFileExists(s *HTTPStaticServer, name string) bool {
+	return IsExists(filepath.Join(s.Root, filepath.FromSlash(name)))
+}
+
+// newTestRequest is a request as matched by the catch-all route /{path:.*}
+func newTestRequest(method, target string, body io.Reader) *http.Request {
+	req := httptest.NewRequest(method, target, body)
+	return mux.SetURLVars(req, map[string]string{"path": strings.TrimPrefix(req.URL.Path, "/")})
+}
+
+func serveTest(handler http.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+func statTestFile(t *testing.T, path string) os.FileInfo {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm   = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat  = "20060102T150405Z"
+	sigV4MaxSkew     = 15 * time.Minute
+	sigV4MaxExpires  = 7 * 24 * 3600 // presigned urls are valid for 7 days at most
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+	streamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	emptySHA256      = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+var (
+	errSignatureMismatch  = &S3APIError{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided. Check your key and signing method."}
+	errInvalidAccessKeyId = &S3APIError{http.StatusForbidden, "InvalidAccessKeyId", "The AWS Access Key Id you provided does not exist in our records."}
+	errContentSHA256      = &S3APIError{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed."}
+
+	reSHA256Hex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+// S3Credential is an access key pair accepted by the s3 api.
+// Requests signed with it act as user Email, whose permissions come from the users rules of .ghs.yml
+type S3Credential struct {
+	AccessKey string `yaml:"accessKey"`
+	SecretKey string `yaml:"secretKey"`
+	Email     string `yaml:"email"`
+}
+
+// sigV4Auth holds the signature of a request, either from the Authorization header
+// or from the query string of a presigned url
+type sigV4Auth struct {
+	AccessKey     string
+	Date          time.Time
+	Scope         string // <yyyymmdd>/<region>/<service>/aws4_request
+	SignedHeaders []string
+	Signature     string
+	Presigned     bool
+	Expires       time.Duration
+}
+
+func sigV4Malformed(message string) error {
+	return &S3APIError{http.StatusBadRequest, "AuthorizationHeaderMalformed", message}
+}
+
+// parseSigV4 returns the signature of req, nil if the request is not signed
+func parseSigV4(req *http.Request) (*sigV4Auth, error) {
+	if authorization := req.Header.Get("Authorization"); authorization != "" {
+		return parseSigV4Header(req, authorization)
+	}
+	query := req.URL.Query()
+	if algorithm := query.Get("X-Amz-Algorithm"); algorithm != "" {
+		if algorithm != sigV4Algorithm {
+			return nil, &S3APIError{http.StatusBadRequest, "InvalidRequest", "The authorization mechanism you have provided is not supported. Please use " + sigV4Algorithm + "."}
+		}
+		return parseSigV4Query(query)
+	}
+	return nil, nil
+}
+
+// Authorization: AWS4-HMAC-SHA256 Credential=<key>/<scope>, SignedHeaders=host;x-amz-date, Signature=<hex>
+func parseSigV4Header(req *http.Request, authorization string) (*sigV4Auth, error) {
+	if !strings.HasPrefix(authorization, sigV4Algorithm+" ") {
+		if strings.HasPrefix(authorization, "AWS ") {
+			return nil, &S3APIError{http.StatusBadRequest, "InvalidRequest", "The authorization mechanism you have provided is not supported. Please use " + sigV4Algorithm + "."}
+		}
+		// 其他类型的Authorization，比如http basic auth，不归s3管
+		return nil, nil
+	}
+	fields := make(map[string]string)
+	for _, field := range strings.Split(strings.TrimPrefix(authorization, sigV4Algorithm), ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			return nil, sigV4Malformed("The authorization header is malformed.")
+		}
+		fields[kv[0]] = kv[1]
+	}
+	a := &sigV4Auth{
+		SignedHeaders: strings.Split(fields["SignedHeaders"], ";"),
+		Signature:     fields["Signature"],
+	}
+	if err := a.parseCredential(fields["Credential"]); err != nil {
+		return nil, err
+	}
+	if fields["SignedHeaders"] == "" || a.Signature == "" {
+		return nil, sigV4Malformed("The authorization header is malformed.")
+	}
+
+	var err error
+	if amzDate := req.Header.Get("X-Amz-Date"); amzDate != "" {
+		a.Date, err = time.Parse(sigV4TimeFormat, amzDate)
+	} else {
+		a.Date, err = http.ParseTime(req.Header.Get("Date"))
+	}
+	if err != nil {
+		return nil, &S3APIError{http.StatusForbidden, "AccessDenied", "AWS authentication requires a valid Date or x-amz-date header"}
+	}
+	return a, nil
+}
+
+func parseSigV4Query(query url.Values) (*sigV4Auth, error) {
+	a := &sigV4Auth{
+		SignedHeaders: strings.Split(query.Get("X-Amz-SignedHeaders"), ";"),
+		Signature:     query.Get("X-Amz-Signature"),
+		Presigned:     true,
+	}
+	if err := a.parseCredential(query.Get("X-Amz-Credential")); err != nil {
+		return nil, err
+	}
+	var err error
+	a.Date, err = time.Parse(sigV4TimeFormat, query.Get("X-Amz-Date"))
+	if err != nil {
+		return nil, &S3APIError{http.StatusBadRequest, "AuthorizationQueryParametersError", "X-Amz-Date must be in the ISO8601 Long Format \"yyyyMMdd'T'HHmmss'Z'\""}
+	}
+	expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+	if err != nil || expires < 1 || expires > sigV4MaxExpires {
+		return nil, &S3APIError{http.StatusBadRequest, "AuthorizationQueryParametersError", "X-Amz-Expires must be a number between 1 and 604800 seconds."}
+	}
+	a.Expires = time.Duration(expires) * time.Second
+	if a.Signature == "" || query.Get("X-Amz-SignedHeaders") == "" {
+		return nil, &S3APIError{http.StatusBadRequest, "AuthorizationQueryParametersError", "Query-string authentication version 4 requires the X-Amz-Algorithm, X-Amz-Credential, X-Amz-Signature, X-Amz-Date, X-Amz-SignedHeaders, and X-Amz-Expires parameters."}
+	}
+	return a, nil
+}
+
+// parseCredential parses <access key>/<yyyymmdd>/<region>/<service>/aws4_request
+func (a *sigV4Auth) parseCredential(credential string) error {
+	parts := strings.SplitN(credential, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || len(strings.Split(parts[1], "/")) != 4 || !strings.HasSuffix(parts[1], "/aws4_request") {
+		return sigV4Malformed("The authorization header is malformed; the Credential is mal-formed; expecting \"<YOUR-AKID>/YYYYMMDD/REGION/SERVICE/aws4_request\".")
+	}
+	a.AccessKey, a.Scope = parts[0], parts[1]
+	return nil
+}
+
+// Verify checks the signature against secretKey, the region in the scope is whatever the client uses
+func (a *sigV4Auth) Verify(req *http.Request, secretKey string, now time.Time) error {
+	if a.Presigned {
+		if now.Before(a.Date.Add(-sigV4MaxSkew)) || now.After(a.Date.Add(a.Expires)) {
+			return &S3APIError{http.StatusForbidden, "AccessDenied", "Request has expired"}
+		}
+	} else if d := now.Sub(a.Date); d > sigV4MaxSkew || d < -sigV4MaxSkew {
+		return &S3APIError{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the current time is too large."}
+	}
+	if !strings.HasPrefix(a.Scope, a.Date.Format("20060102")+"/") {
+		return errSignatureMismatch
+	}
+	signature := hex.EncodeToString(hmacSHA256(a.signingKey(secretKey), a.stringToSign(req)))
+	if !hmac.Equal([]byte(signature), []byte(a.Signature)) {
+		return errSignatureMismatch
+	}
+	return nil
+}
+
+func (a *sigV4Auth) signingKey(secretKey string) []byte {
+	key := []byte("AWS4" + secretKey)
+	for _, part := range strings.Split(a.Scope, "/") {
+		key = hmacSHA256(key, part)
+	}
+	return key
+}
+
+func (a *sigV4Auth) stringToSign(req *http.Request) string {
+	sum := sha256.Sum256([]byte(a.canonicalRequest(req)))
+	return strings.Join([]string{
+		sigV4Algorithm,
+		a.Date.UTC().Format(sigV4TimeFormat),
+		a.Scope,
+		hex.EncodeToString(sum[:]),
+	}, "\n")
+}
+
+func (a *sigV4Auth) canonicalRequest(req *http.Request) string {
+	query := req.URL.Query()
+	if a.Presigned {
+		query.Del("X-Amz-Signature")
+	}
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	params := make([]string, 0, len(keys))
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, sigV4Escape(k, true)+"="+sigV4Escape(v, true))
+		}
+	}
+
+	headers := make([]string, 0, len(a.SignedHeaders))
+	for _, name := range a.SignedHeaders {
+		headers = append(headers, name+":"+sigV4HeaderValue(req, name)+"\n")
+	}
+
+	path := req.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	return strings.Join([]string{
+		req.Method,
+		sigV4Escape(path, false),
+		strings.Join(params, "&"),
+		strings.Join(headers, ""),
+		strings.Join(a.SignedHeaders, ";"),
+		a.payloadHash(req),
+	}, "\n")
+}
+
+// payloadHash is the x-amz-content-sha256 claimed by the client, presigned urls don't sign the payload
+func (a *sigV4Auth) payloadHash(req *http.Request) string {
+	if hash := req.Header.Get("X-Amz-Content-Sha256"); hash != "" {
+		return hash
+	}
+	if hash := req.URL.Query().Get("X-Amz-Content-Sha256"); hash != "" {
+		return hash
+	}
+	if a.Presigned {
+		return unsignedPayload
+	}
+	return emptySHA256
+}
+
+var reSpaces = regexp.MustCompile(`\s+`)
+
+func sigV4HeaderValue(req *http.Request, name string) string {
+	// go server moves these headers out of req.Header
+	switch name {
+	case "host":
+		return req.Host
+	case "content-length":
+		if req.Header.Get("Content-Length") == "" && req.ContentLength >= 0 {
+			return strconv.FormatInt(req.ContentLength, 10)
+		}
+	case "transfer-encoding":
+		return strings.Join(req.TransferEncoding, ",")
+	}
+	values := req.Header[http.CanonicalHeaderKey(name)]
+	trimmed := make([]string, 0, len(values))
+	for _, v := range values {
+		trimmed = append(trimmed, reSpaces.ReplaceAllString(strings.TrimSpace(v), " "))
+	}
+	return strings.Join(trimmed, ",")
+}
+
+// sigV4Escape is the uri encoding of aws signature, only A-Za-z0-9-._~ are kept as is
+func sigV4Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3ChunkVerifier checks chunk signatures of STREAMING-AWS4-HMAC-SHA256-PAYLOAD bodies,
+// every chunk is signed with the signature of the previous one, starting from the request signature
+type s3ChunkVerifier struct {
+	key     []byte
+	date    string
+	scope   string
+	prevSig string
+}
+
+func (v *s3ChunkVerifier) verify(signature string, dataHash []byte) bool {
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm + "-PAYLOAD",
+		v.date,
+		v.scope,
+		v.prevSig,
+		emptySHA256,
+		hex.EncodeToString(dataHash),
+	}, "\n")
+	expected := hex.EncodeToString(hmacSHA256(v.key, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return false
+	}
+	v.prevSig = signature
+	return true
+}
+
+type s3ChunkVerifierKey struct{}
+
+func requestChunkVerifier(req *http.Request) *s3ChunkVerifier {
+	v, _ := req.Context().Value(s3ChunkVerifierKey{}).(*s3ChunkVerifier)
+	return v
+}
+
+// sha256Body fails the last read if the body does not match x-amz-content-sha256
+type sha256Body struct {
+	io.ReadCloser
+	h        hash.Hash
+	expected string
+}
+
+func (b *sha256Body) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.h.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(b.h.Sum(nil)) != b.expected {
+		return n, errContentSHA256
+	}
+	return n, err
+}
+
+// lookupS3Credential finds the secret key of accessKey in config first, and then in the users of .ghs.yml.
+// The returned user is who the request acts as.
+func (s *HTTPStaticServer) lookupS3Credential(accessKey, path string) (secretKey string, user *UserInfo) {
+	for _, cred := range s.S3Credentials {
+		if cred.AccessKey == accessKey {
+			return cred.SecretKey, s3CredentialUser(accessKey, cred.Email)
+		}
+	}
+	auth := s.readAccessConf(filepath.Clean("/" + path))
+	for _, rule := range auth.Users {
+		if rule.AccessKey == accessKey && rule.SecretKey != "" {
+			return rule.SecretKey, s3CredentialUser(accessKey, rule.Email)
+		}
+	}
+	return "", nil
+}
+
+func s3CredentialUser(accessKey, email string) *UserInfo {
+	if email == "" {
+		// 没有email的key不能匹配到.ghs.yml里面没写email的规则
+		email = accessKey
+	}
+	return &UserInfo{Id: accessKey, Email: email, Name: accessKey}
+}
+
+// authenticateS3 verifies aws signature v4 of the request.
+// Signed requests act as the user of the access key, unsigned requests are anonymous as before.
+func (s *HTTPStaticServer) authenticateS3(req *http.Request) (*http.Request, error) {
+	a, err := parseSigV4(req)
+	if err != nil || a == nil {
+		return req, err
+	}
+	path := req.URL.Path
+	if bucket := s.s3VirtualHostBucket(req); bucket != "" {
+		path = "/" + bucket + path
+	}
+	var secretKey string
+	var user *UserInfo
+	grant := a.AccessKey == presignAccessKey
+	if grant {
+		// 服务端自己签发的url，只认presigned的形式
+		if !a.Presigned || s.S3PresignSecret == "" {
+			return req, errInvalidAccessKeyId
+		}
+		secretKey = s.S3PresignSecret
+	} else if secretKey, user = s.lookupS3Credential(a.AccessKey, path); user == nil {
+		return req, errInvalidAccessKeyId
+	}
+	if err := a.Verify(req, secretKey, time.Now()); err != nil {
+		return req, err
+	}
+
+	// urls presigned by the server are anonymous, with the upload permission checked when generating them
+	ctx := context.WithValue(req.Context(), userContextKey{}, user)
+	if grant {
+		ctx = context.WithValue(ctx, presignGrantKey{}, &presignGrant{Path: path})
+	}
+	payloadHash := a.payloadHash(req)
+	switch {
+	case strings.HasPrefix(payloadHash, streamingPayload):
+		ctx = context.WithValue(ctx, s3ChunkVerifierKey{}, &s3ChunkVerifier{
+			key:     a.signingKey(secretKey),
+			date:    a.Date.UTC().Format(sigV4TimeFormat),
+			scope:   a.Scope,
+			prevSig: a.Signature,
+		})
+	case reSHA256Hex.MatchString(payloadHash):
+		req.Body = &sha256Body{req.Body, sha256.New(), payloadHash}
+	}
+	return req.WithContext(ctx), nil
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// trashDirName is the hidden directory under root keeping deleted files and directories,
+// every entry is .ghs-trash/<id>/ with the deleted data and a json record of it
+const trashDirName = ".ghs-trash"
+
+const (
+	trashInfoFile = "info.json"
+	trashDataName = "data"
+)
+
+// TrashEntry is a deleted file or directory which can be restored until it is purged
+type TrashEntry struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path"` // original path relative to root
+	IsDir     bool      `json:"isDir"`
+	Size      int64     `json:"size"`
+	Files     int64     `json:"files"`
+	DeletedAt time.Time `json:"deletedAt"`
+	DeletedBy string    `json:"deletedBy,omitempty"` // email of who deleted it, empty for anonymous
+	Meta      *FileMeta `json:"meta,omitempty"`      // restored together with the file
+
+	dir string
+}
+
+func (e *TrashEntry) dataPath() string {
+	return filepath.Join(e.dir, trashDataName)
+}
+
+func isTrashPath(path string) bool {
+	path = strings.TrimPrefix(filepath.ToSlash(filepath.Clean("/"+path)), "/")
+	return path == trashDirName || strings.HasPrefix(path, trashDirName+"/")
+}
+
+func (s *HTTPStaticServer) trashDir() string {
+	return filepath.Join(s.Root, trashDirName)
+}
+
+// pathUsage returns total size and count of the files under path, versions included, meta and temp files are not counted
+func pathUsage(path string) (size, files int64) {
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() && info.Name() != metaFileName && !isTempFile(info.Name()) {
+			size += info.Size()
+			files++
+		}
+		return nil
+	})
+	return
+}
+
+// movePath renames src to dst, and copies then removes src when they are on different devices,
+// eg: a directory under root which is another mount point
+func movePath(src, dst string) error {
+	err := os.Rename(src, dst)
+	if le, ok := err.(*os.LinkError); !ok || le.Err != syscall.EXDEV {
+		return err
+	}
+	if err := copyTree(src, dst); err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// copyTree copies a file or directory with the modes and mtimes, symlinks are copied as symlinks
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case !info.Mode().IsRegular():
+			return nil
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, in)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(target, info.ModTime(), info.ModTime())
+	})
+}
+
+// moveToTrash moves the file or directory at path (relative to root) into the trash
+func (s *HTTPStaticServer) moveToTrash(path string, req *http.Request) (*TrashEntry, error) {
+	localPath := filepath.Join(s.Root, path)
+	info, err := os.Lstat(localPath)
+	if err != nil {
+		return nil, err
+	}
+	id, err := newMultipartUploadId()
+	if err != nil {
+		return nil, err
+	}
+	e := &TrashEntry{
+		ID:        id,
+		Path:      multipartKey(path),
+		IsDir:     info.IsDir(),
+		DeletedAt: time.Now(),
+		dir:       filepath.Join(s.trashDir(), id),
+	}
+	e.Size, e.Files = pathUsage(localPath)
+	if user := currentUser(req); user != nil {
+		e.DeletedBy = user.Email
+	}
+	if !info.IsDir() {
+		e.Meta = getFileMeta(localPath, info)
+	}
+	if err := os.MkdirAll(e.dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	data, _ := json.Marshal(e)
+	if err := ioutil.WriteFile(filepath.Join(e.dir, trashInfoFile), data, 0644); err != nil {
+		os.RemoveAll(e.dir)
+		return nil, err
+	}
+	// 同一个文件系统内rename，大目录也是瞬间完成，跨设备的才需要复制
+	if err := movePath(localPath, e.dataPath()); err != nil {
+		os.RemoveAll(e.dir)
+		return nil, err
+	}
+	if !info.IsDir() {
+		removeFileMeta(localPath)
+	}
+	return e, nil
+}
+
+// trashEntry reads the record of a trash entry, nil if there is no such entry or its data is gone
+func (s *HTTPStaticServer) trashEntry(id string) *TrashEntry {
+	if !reMultipartUploadId.MatchString(id) {
+		return nil
+	}
+	dir := filepath.Join(s.trashDir(), id)
+	data, err := ioutil.ReadFile(filepath.Join(dir, trashInfoFile))
+	if err != nil {
+		return nil
+	}
+	e := &TrashEntry{}
+	if err := json.Unmarshal(data, e); err != nil || e.ID != id {
+		return nil
+	}
+	e.dir = dir
+	if _, err := os.Lstat(e.dataPath()); err != nil {
+		return nil
+	}
+	return e
+}
+
+// trashEntries returns all entries in the trash, the latest deleted first
+func (s *HTTPStaticServer) trashEntries() []*TrashEntry {
+	finfos, err := ioutil.ReadDir(s.trashDir())
+	if err != nil {
+		return nil
+	}
+	entries := make([]*TrashEntry, 0, len(finfos))
+	for _, fi := range finfos {
+		if e := s.trashEntry(fi.Name()); e != nil {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].DeletedAt.After(entries[j].DeletedAt)
+	})
+	return entries
+}
+
+// restoreTrash moves the entry back to where it was deleted, which must not exist again
+func (s *HTTPStaticServer) restoreTrash(e *TrashEntry) error {
+	dstPath := filepath.Join(s.Root, e.Path)
+	unlock := s.pathLocks.Lock(e.Path)
+	defer unlock()
+	if _, err := os.Lstat(dstPath); err == nil {
+		return errFileExists
+	}
+	if err := os.MkdirAll(filepath.Dir(dstPath), os.ModePerm); err != nil {
+		return err
+	}
+	// 回收站里的文件一直算在原来目录的quota里，恢复不改变用量
+	if err := movePath(e.dataPath(), dstPath); err != nil {
+		return err
+	}
+	if e.Meta != nil {
+		setFileMeta(dstPath, e.Meta)
+	}
+	return os.RemoveAll(e.dir)
+}
+
+// purgeTrash removes the entry for good, its files no longer count in quotas of where it was deleted
+func (s *HTTPStaticServer) purgeTrash(e *TrashEntry) error {
+	if err := os.RemoveAll(e.dir); err != nil {
+		return err
+	}
+	s.addQuotaUsage(s.readAccessConf(e.Path), -e.Size, -e.Files)
+	return nil
+}
+
+// reapTrash purges entries deleted more than TrashExpire ago, and leftovers of interrupted deletes
+func (s *HTTPStaticServer) reapTrash() {
+	if s.TrashExpire <= 0 {
+		return
+	}
+	finfos, err := ioutil.ReadDir(s.trashDir())
+	if err != nil {
+		return
+	}
+	deadline := time.Now().Add(-s.TrashExpire)
+	count, reclaimed := 0, int64(0)
+	for _, fi := range finfos {
+		e := s.trashEntry(fi.Name())
+		if e == nil && fi.ModTime().After(deadline) {
+			continue
+		}
+		if e != nil && e.DeletedAt.After(deadline) {
+			continue
+		}
+		size, _ := pathUsage(filepath.Join(s.trashDir(), fi.Name()))
+		if e != nil {
+			err = s.purgeTrash(e)
+		} else {
+			err = os.RemoveAll(filepath.Join(s.trashDir(), fi.Name()))
+		}
+		if err != nil {
+			log.Printf("Purge trash %s: %v", fi.Name(), err)
+			continue
+		}
+		count++
+		reclaimed += size
+	}
+	if count > 0 {
+		log.Printf("Purged %d expired trash entries, reclaimed %d bytes", count, reclaimed)
+	}
+}
+
+// hTrash lists, restores and purges deleted files, users only see what they can delete.
+//
+//	GET    /-/trash                 list entries
+//	POST   /-/trash/{id}?op=restore restore to the original path
+//	DELETE /-/trash/{id}            purge one entry
+//	DELETE /-/trash                 purge all entries the user can delete
+func (s *HTTPStaticServer) hTrash(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if id == "" {
+		switch r.Method {
+		case "GET":
+			s.hTrashList(w, r)
+		case "DELETE":
+			s.hTrashPurgeAll(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	e := s.trashEntry(id)
+	if e == nil {
+		http.Error(w, "Trash entry not found", http.StatusNotFound)
+		return
+	}
+	auth := s.readAccessConf(e.Path)
+	if !auth.canDelete(r) {
+		http.Error(w, "Trash entry forbidden", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(e)
+	case "POST":
+		if r.FormValue("op") != "restore" {
+			http.Error(w, "op should be restore", http.StatusBadRequest)
+			return
+		}
+		if !auth.canUpload(r) {
+			http.Error(w, "Upload forbidden", http.StatusForbidden)
+			return
+		}
+		if err := s.restoreTrash(e); err != nil {
+			writeUploadError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json;charset=utf-8")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":     true,
+			"destination": e.Path,
+		})
+	case "DELETE":
+		if err := s.purgeTrash(e); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// visibleTrash returns entries which can be deleted by the user of r
+func (s *HTTPStaticServer) visibleTrash(r *http.Request) []*TrashEntry {
+	entries := make([]*TrashEntry, 0)
+	for _, e := range s.trashEntries() {
+		auth := s.readAccessConf(e.Path)
+		if auth.canDelete(r) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+func (s *HTTPStaticServer) hTrashList(w http.ResponseWriter, r *http.Request) {
+	data, _ := json.Marshal(map[string]interface{}{
+		"entries": s.visibleTrash(r),
+		"expire":  int64(s.TrashExpire / time.Second), // seconds before an entry is purged, 0 is never
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (s *HTTPStaticServer) hTrashPurgeAll(w http.ResponseWriter, r *http.Request) {
+	purged := 0
+	for _, e := range s.visibleTrash(r) {
+		if err := s.purgeTrash(e); err != nil {
+			log.Printf("Purge trash %s: %v", e.ID, err)
+			continue
+		}
+		purged++
+	}
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"purged":  purged,
+	})
+}
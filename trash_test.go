@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsTrashPath(t *testing.T) {
+	assert.True(t, isTrashPath(".ghs-trash"))
+	assert.True(t, isTrashPath("/.ghs-trash/abc/data"))
+	assert.True(t, isTrashPath("foo/../.ghs-trash/"))
+	assert.False(t, isTrashPath("foo/.ghs-trash"))
+	assert.False(t, isTrashPath(".ghs-trash2"))
+}
+
+func TestCopyTree(t *testing.T) {
+	// what movePath does across devices
+	s := newTestServer(t, map[string]string{
+		"src/a.txt":     "hello",
+		"src/sub/b.txt": "world",
+		"src/empty/":    "",
+	})
+	src := filepath.Join(s.Root, "src")
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes(filepath.Join(src, "a.txt"), mtime, mtime)
+	os.Chmod(filepath.Join(src, "sub/b.txt"), 0600)
+	os.Symlink("a.txt", filepath.Join(src, "link"))
+
+	assert.NoError(t, copyTree(src, filepath.Join(s.Root, "dst")))
+	assert.Equal(t, "hello", readTestFile(s, "dst/a.txt"))
+	assert.Equal(t, "world", readTestFile(s, "dst/sub/b.txt"))
+	assert.True(t, isDir(filepath.Join(s.Root, "dst/empty")))
+	assert.True(t, statTestFile(t, filepath.Join(s.Root, "dst/a.txt")).ModTime().Equal(mtime))
+	assert.Equal(t, os.FileMode(0600), statTestFile(t, filepath.Join(s.Root, "dst/sub/b.txt")).Mode().Perm())
+	link, err := os.Readlink(filepath.Join(s.Root, "dst/link"))
+	assert.NoError(t, err)
+	assert.Equal(t, "a.txt", link)
+
+	// never writes over existing files
+	assert.Error(t, copyTree(src, filepath.Join(s.Root, "dst")))
+	assert.Equal(t, "hello", readTestFile(s, "src/a.txt"))
+
+	assert.NoError(t, movePath(src, filepath.Join(s.Root, "moved")))
+	assert.False(t, testFileExists(s, "src/a.txt"))
+	assert.Equal(t, "hello", readTestFile(s, "moved/a.txt"))
+}
+
+func TestTrash(t *testing.T) {
+	s := newTestServer(t, map[string]string{"build/sub/a.txt": "hello"})
+	s.Trash = true
+	req := newTestRequest("DELETE", "/build/sub", nil)
+	e, err := s.moveToTrash("build/sub", req)
+	assert.NoError(t, err)
+	assert.False(t, testFileExists(s, "build/sub"))
+	assert.Equal(t, "build/sub", e.Path)
+	assert.True(t, e.IsDir)
+	assert.Equal(t, int64(5), e.Size)
+	assert.Equal(t, int64(1), e.Files)
+
+	entries := s.trashEntries()
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, e.ID, entries[0].ID)
+	}
+	assert.Nil(t, s.trashEntry("../build"))
+
+	// restore fails when the path is taken again
+	writeTestFiles(t, s, map[string]string{"build/sub/": ""})
+	assert.Equal(t, errFileExists, s.restoreTrash(entries[0]))
+	os.Remove(filepath.Join(s.Root, "build/sub"))
+	assert.NoError(t, s.restoreTrash(entries[0]))
+	assert.Equal(t, "hello", readTestFile(s, "build/sub/a.txt"))
+	assert.Empty(t, s.trashEntries())
+
+	// expired entries are purged
+	_, err = s.moveToTrash("build/sub/a.txt", req)
+	assert.NoError(t, err)
+	s.TrashExpire = time.Hour
+	s.reapTrash()
+	assert.Len(t, s.trashEntries(), 1)
+	s.TrashExpire = time.Nanosecond
+	s.reapTrash()
+	assert.Empty(t, s.trashEntries())
+}
+
+func newTrashRequest(method, id, query string) *http.Request {
+	target := "/-/trash"
+	if id != "" {
+		target += "/" + id
+	}
+	req := httptest.NewRequest(method, target+query, nil)
+	return mux.SetURLVars(req, map[string]string{"id": id})
+}
+
+func TestTrashHandler(t *testing.T) {
+	s := newTestServer(t, map[string]string{
+		"a.txt":              "hello",
+		"b.txt":              "world",
+		"locked/c.txt":       "locked",
+		"locked/" + YAMLCONF: "delete: false\n",
+	})
+	s.Trash = true
+	for _, path := range []string{"a.txt", "b.txt"} {
+		assert.Equal(t, http.StatusNoContent, serveTest(s.hDelete, newTestRequest("DELETE", "/"+path, nil)).Code)
+	}
+	// deleted by someone who could, the trash entry is invisible to users who can not delete there
+	_, err := s.moveToTrash("locked/c.txt", newTestRequest("DELETE", "/locked/c.txt", nil))
+	assert.NoError(t, err)
+
+	list := func() []*TrashEntry {
+		w := serveTest(s.hTrash, newTrashRequest("GET", "", ""))
+		assert.Equal(t, http.StatusOK, w.Code)
+		var result struct {
+			Entries []*TrashEntry `json:"entries"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+		return result.Entries
+	}
+	entries := list()
+	assert.Len(t, entries, 2)
+	ids := make(map[string]string)
+	for _, e := range entries {
+		ids[e.Path] = e.ID
+	}
+	lockedID := ""
+	for _, e := range s.trashEntries() {
+		if e.Path == "locked/c.txt" {
+			lockedID = e.ID
+		}
+	}
+
+	// restore
+	w := serveTest(s.hTrash, newTrashRequest("POST", ids["a.txt"], ""))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = serveTest(s.hTrash, newTrashRequest("POST", ids["a.txt"], "?op=restore"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "hello", readTestFile(s, "a.txt"))
+	w = serveTest(s.hTrash, newTrashRequest("POST", ids["a.txt"], "?op=restore"))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = serveTest(s.hTrash, newTrashRequest("POST", lockedID, "?op=restore"))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.False(t, testFileExists(s, "locked/c.txt"))
+
+	// purge one
+	w = serveTest(s.hTrash, newTrashRequest("DELETE", lockedID, ""))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = serveTest(s.hTrash, newTrashRequest("DELETE", ids["b.txt"], ""))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, list())
+	assert.Len(t, s.trashEntries(), 1)
+
+	// purge all only purges what the user can delete
+	assert.Equal(t, http.StatusNoContent, serveTest(s.hDelete, newTestRequest("DELETE", "/a.txt", nil)).Code)
+	w = serveTest(s.hTrash, newTrashRequest("DELETE", "", ""))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"purged":1`)
+	if entries := s.trashEntries(); assert.Len(t, entries, 1) {
+		assert.Equal(t, lockedID, entries[0].ID)
+	}
+}
+
+func TestS3DeleteToTrash(t *testing.T) {
+	s := newTestServer(t, map[string]string{"bkt/a.txt": "a", "bkt/b.txt": "b", "bkt/c.txt": "c"})
+	s.S3 = true
+	s.Trash = true
+
+	w := serveTest(s.hDelete, newS3Request("DELETE", "/bkt/a.txt", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	body := `<Delete><Object><Key>b.txt</Key></Object><Object><Key>missing.txt</Key></Object>` +
+		`<Object><Key>.ghs-versions/c.txt/20200102T030405.000000006Z</Key></Object></Delete>`
+	w = serveTest(s.hUploadOrMkdir, newS3Request("POST", "/bkt?delete", strings.NewReader(body)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "<Key>missing.txt</Key>")
+	assert.Contains(t, w.Body.String(), "AccessDenied")
+
+	assert.False(t, testFileExists(s, "bkt/a.txt"))
+	assert.False(t, testFileExists(s, "bkt/b.txt"))
+	paths := []string{}
+	for _, e := range s.trashEntries() {
+		paths = append(paths, e.Path)
+	}
+	assert.ElementsMatch(t, []string{"bkt/a.txt", "bkt/b.txt"}, paths)
+}
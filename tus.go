@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// tus resumable upload protocol 1.0, with creation, termination and checksum extensions.
+// https://tus.io/protocols/resumable-upload
+const (
+	tusVersion            = "1.0.0"
+	tusExtensions         = "creation,termination,checksum"
+	tusChecksumAlgorithms = "md5,sha1,sha256"
+	tusSessionFile        = "info.json"
+	tusDataFile           = "data"
+
+	// StatusChecksumMismatch is defined by tus checksum extension
+	StatusChecksumMismatch = 460
+)
+
+var errNoSuchTusUpload = errors.New("upload not found")
+
+// TusUpload is an upload created by tus creation extension,
+// the data received so far is kept in its directory, so the offset is the size of the data file.
+type TusUpload struct {
+	ID       string    `json:"id"`
+	Path     string    `json:"path"` // target path relative to root, eg: foo/bar.txt
+	Length   int64     `json:"length"`
+	Metadata string    `json:"metadata"` // Upload-Metadata header as received
+	Owner    string    `json:"owner"`    // email of the creator, empty for anonymous
+	Created  time.Time `json:"created"`
+	Meta     FileMeta  `json:"meta"`
+	Conflict string    `json:"conflict,omitempty"` // what to do if the file exists when the upload finishes
+
+	dir string
+}
+
+func (u *TusUpload) dataPath() string {
+	return filepath.Join(u.dir, tusDataFile)
+}
+
+// Offset returns how many bytes have been received
+func (u *TusUpload) Offset() (int64, error) {
+	info, err := os.Stat(u.dataPath())
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// LastActivity returns when data was received last time
+func (u *TusUpload) LastActivity() time.Time {
+	if info, err := os.Stat(u.dataPath()); err == nil && info.ModTime().After(u.Created) {
+		return info.ModTime()
+	}
+	return u.Created
+}
+
+// TusRegistry keeps track of tus uploads, every upload owns a directory under dir
+type TusRegistry struct {
+	dir     string
+	mu      sync.Mutex
+	uploads map[string]*TusUpload
+	locks   keyedMutex // PATCH requests of the same upload are serialized
+}
+
+func NewTusRegistry(dir string) *TusRegistry {
+	r := &TusRegistry{
+		dir:     dir,
+		uploads: make(map[string]*TusUpload),
+	}
+	finfos, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("WARN: load tus uploads from %s: %v", dir, err)
+	}
+	for _, fi := range finfos {
+		if !fi.IsDir() {
+			continue
+		}
+		udir := filepath.Join(dir, fi.Name())
+		data, err := ioutil.ReadFile(filepath.Join(udir, tusSessionFile))
+		u := &TusUpload{}
+		if err == nil {
+			err = json.Unmarshal(data, u)
+		}
+		if err != nil || u.ID != fi.Name() {
+			log.Printf("Remove orphan tus upload directory: %s", udir)
+			os.RemoveAll(udir)
+			continue
+		}
+		u.dir = udir
+		r.uploads[u.ID] = u
+	}
+	if len(r.uploads) > 0 {
+		log.Printf("Loaded %d tus uploads from %s", len(r.uploads), dir)
+	}
+	return r
+}
+
+// Create registers the upload with an empty data file
+func (r *TusRegistry) Create(u *TusUpload) error {
+	id, err := newMultipartUploadId()
+	if err != nil {
+		return err
+	}
+	u.ID = id
+	u.Created = time.Now()
+	u.dir = filepath.Join(r.dir, id)
+	if err := os.MkdirAll(u.dir, os.ModePerm); err != nil {
+		return err
+	}
+	data, err := json.Marshal(u)
+	if err == nil {
+		err = ioutil.WriteFile(u.dataPath(), nil, 0644)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(u.dir, tusSessionFile), data, 0644)
+	}
+	if err != nil {
+		os.RemoveAll(u.dir)
+		return err
+	}
+	r.mu.Lock()
+	r.uploads[id] = u
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *TusRegistry) Get(id string) (*TusUpload, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.uploads[id]
+	if !ok {
+		return nil, errNoSuchTusUpload
+	}
+	c := *u
+	return &c, nil
+}
+
+func (r *TusRegistry) Remove(id string) error {
+	r.mu.Lock()
+	u, ok := r.uploads[id]
+	delete(r.uploads, id)
+	r.mu.Unlock()
+	if !ok {
+		return errNoSuchTusUpload
+	}
+	return os.RemoveAll(u.dir)
+}
+
+// Reap removes uploads without any activity since deadline
+func (r *TusRegistry) Reap(deadline time.Time) (count int, reclaimed int64) {
+	r.mu.Lock()
+	uploads := make([]*TusUpload, 0, len(r.uploads))
+	for _, u := range r.uploads {
+		uploads = append(uploads, u)
+	}
+	r.mu.Unlock()
+	for _, u := range uploads {
+		if u.LastActivity().After(deadline) {
+			continue
+		}
+		size := diskUsage(u.dir)
+		if err := r.Remove(u.ID); err != nil {
+			continue
+		}
+		log.Printf("Reaped tus upload %s of %s, last activity %v", u.ID, u.Path, u.LastActivity())
+		count++
+		reclaimed += size
+	}
+	return
+}
+
+// parseTusMetadata parses Upload-Metadata: key base64value,key2 base64value2
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, " ", 2)
+		value := ""
+		if len(kv) == 2 {
+			data, err := base64.StdEncoding.DecodeString(kv[1])
+			if err != nil {
+				return nil, errors.New("Invalid Upload-Metadata")
+			}
+			value = string(data)
+		}
+		metadata[kv[0]] = value
+	}
+	return metadata, nil
+}
+
+func newTusChecksumHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case "md5":
+		return md5.New()
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	}
+	return nil
+}
+
+func (s *HTTPStaticServer) tusUploads() *TusRegistry {
+	s.tusOnce.Do(func() {
+		stagingDir := s.StagingDir
+		if stagingDir == "" {
+			stagingDir = os.TempDir()
+		}
+		s.tus = NewTusRegistry(filepath.Join(stagingDir, ".ghs-tus-temp"))
+	})
+	return s.tus
+}
+
+func (s *HTTPStaticServer) reapTusUploads() {
+	if s.MultipartExpire <= 0 {
+		return
+	}
+	count, reclaimed := s.tusUploads().Reap(time.Now().Add(-s.MultipartExpire))
+	if count > 0 {
+		log.Printf("Reaped %d abandoned tus uploads, reclaimed %d bytes", count, reclaimed)
+	}
+}
+
+// hTus handles /-/tus/ (creation) and /-/tus/{id}
+func (s *HTTPStaticServer) hTus(w http.ResponseWriter, r *http.Request) {
+	method := r.Method
+	if override := r.Header.Get("X-HTTP-Method-Override"); override != "" {
+		method = strings.ToUpper(override)
+	}
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if method == "OPTIONS" {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.Header().Set("Tus-Checksum-Algorithm", tusChecksumAlgorithms)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	if id == "" {
+		if method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.hTusCreate(w, r)
+		return
+	}
+
+	u, err := s.tusUploads().Get(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if u.Owner != "" && u.Owner != multipartOwner(r) {
+		http.Error(w, "The upload was created by another user", http.StatusForbidden)
+		return
+	}
+	switch method {
+	case "HEAD":
+		s.hTusHead(w, r, u)
+	case "PATCH":
+		s.hTusPatch(w, r, u)
+	case "DELETE":
+		s.tusUploads().Remove(u.ID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// hTusCreate creates an upload, the target is given by Upload-Metadata:
+// filename (required), path (directory relative to root, default root) and filetype
+func (s *HTTPStaticServer) hTusCreate(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dir := metadata["path"]
+	if !IsSafePath(dir) {
+		http.Error(w, "Invalid parent directory accessing.", http.StatusBadRequest)
+		return
+	}
+	filename := metadata["filename"]
+	if err := checkFilename(filename); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	path := multipartKey(filepath.Join(dir, filename))
+	// 和普通上传一样，每一级目录都要检查，不能写到.ghs-versions之类的内部目录
+	if err := checkRelativePath(path); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if filename == YAMLCONF {
+		http.Error(w, YAMLCONF+" can not be uploaded by tus", http.StatusForbidden)
+		return
+	}
+
+	auth := s.readAccessConf(filepath.Dir(path))
+	if !auth.canUpload(r) {
+		http.Error(w, "Upload forbidden", http.StatusForbidden)
+		return
+	}
+	if err := auth.checkExtension(filename); err != nil {
+		writeTusError(w, err)
+		return
+	}
+	if err := auth.checkFileSize(length); err != nil {
+		writeTusError(w, err)
+		return
+	}
+	if err := s.checkQuotaSize(auth, filepath.Join(s.Root, path), length); err != nil {
+		writeTusError(w, err)
+		return
+	}
+	if isDir(filepath.Join(s.Root, path)) {
+		http.Error(w, "A directory with the same name exists.", http.StatusConflict)
+		return
+	}
+	// tus的POST只是创建上传，默认和PUT一样覆盖，metadata里的conflict和.ghs.yml的默认值同普通上传
+	conflict := metadata["conflict"]
+	for _, c := range []string{conflict, auth.Conflict} {
+		if err := checkConflict(c); err != nil {
+			writeTusError(w, err)
+			return
+		}
+	}
+	if conflict == "" {
+		conflict = auth.Conflict
+	}
+	if conflict == "" {
+		conflict = conflictOverwrite
+	}
+	if conflict == conflictReject && isFile(filepath.Join(s.Root, path)) {
+		writeTusError(w, errFileExists)
+		return
+	}
+
+	owner := multipartOwner(r)
+	u := &TusUpload{
+		Path:     path,
+		Length:   length,
+		Metadata: r.Header.Get("Upload-Metadata"),
+		Owner:    owner,
+		Meta:     FileMeta{ContentType: metadata["filetype"], Uploader: owner},
+		Conflict: conflict,
+	}
+	if err := s.tusUploads().Create(u); err != nil {
+		log.Println("Create tus upload:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("tus upload %s created for %s, length %d", u.ID, u.Path, u.Length)
+	if length == 0 {
+		if err := s.finishTusUpload(u); err != nil {
+			writeTusError(w, err)
+			return
+		}
+	}
+	w.Header().Set("Location", "/-/tus/"+u.ID)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *HTTPStaticServer) hTusHead(w http.ResponseWriter, r *http.Request, u *TusUpload) {
+	offset, err := u.Offset()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	if u.Metadata != "" {
+		w.Header().Set("Upload-Metadata", u.Metadata)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *HTTPStaticServer) hTusPatch(w http.ResponseWriter, r *http.Request, u *TusUpload) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type should be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	var checksum []byte
+	var h hash.Hash
+	if value := r.Header.Get("Upload-Checksum"); value != "" {
+		parts := strings.SplitN(value, " ", 2)
+		h = newTusChecksumHash(parts[0])
+		if h == nil || len(parts) != 2 {
+			http.Error(w, "Unsupported checksum algorithm", http.StatusBadRequest)
+			return
+		}
+		var err error
+		if checksum, err = base64.StdEncoding.DecodeString(parts[1]); err != nil {
+			http.Error(w, "Invalid Upload-Checksum", http.StatusBadRequest)
+			return
+		}
+	}
+
+	unlock := s.tusUploads().locks.Lock(u.ID)
+	defer unlock()
+	if _, err := s.tusUploads().Get(u.ID); err != nil {
+		// terminated while waiting for the lock
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	offset, err := u.Offset()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if r.Header.Get("Upload-Offset") != strconv.FormatInt(offset, 10) {
+		http.Error(w, "Upload-Offset mismatch, current offset is "+strconv.FormatInt(offset, 10), http.StatusConflict)
+		return
+	}
+
+	f, err := os.OpenFile(u.dataPath(), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var dst io.Writer = f
+	if h != nil {
+		dst = io.MultiWriter(f, h)
+	}
+	// 多读1个字节来判断是否超过Upload-Length
+	n, err := io.Copy(dst, io.LimitReader(r.Body, u.Length-offset+1))
+	if err == nil && offset+n > u.Length {
+		err = errors.New("Upload-Length exceeded")
+	}
+	if err != nil && h == nil && offset+n <= u.Length {
+		// 不带checksum的保留已经收到的部分，客户端可以从HEAD拿到的offset继续传
+		f.Close()
+		log.Printf("tus upload %s interrupted at %d: %v", u.ID, offset+n, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil || (h != nil && !bytes.Equal(h.Sum(nil), checksum)) {
+		// 带checksum的数据要整块丢掉
+		f.Truncate(offset)
+		f.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(w, "Checksum Mismatch", StatusChecksumMismatch)
+		}
+		return
+	}
+	if err := f.Close(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	offset += n
+	if offset == u.Length {
+		if err := s.finishTusUpload(u); err != nil {
+			log.Printf("Finish tus upload %s: %v", u.ID, err)
+			writeTusError(w, err)
+			return
+		}
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishTusUpload moves the received data to the target path and forgets the upload
+func (s *HTTPStaticServer) finishTusUpload(u *TusUpload) error {
+	dstPath := filepath.Join(s.Root, u.Path)
+	if err := os.MkdirAll(filepath.Dir(dstPath), os.ModePerm); err != nil {
+		return err
+	}
+	src, err := os.Open(u.dataPath())
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := CreatePendingFile(dstPath)
+	if err != nil {
+		return err
+	}
+	defer dst.Abort()
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	}
+	// 内容不符合上传限制的话，收到的数据也没用了
+	auth := s.readAccessConf(u.Path)
+	if u.Conflict == conflictVersion {
+		auth.Versioning.Enable = true
+	}
+	if err := auth.checkUploadedFile(dst.File); err != nil {
+		s.tusUploads().Remove(u.ID)
+		return err
+	}
+
+	// 和普通上传一样，创建之后才出现的同名文件也按conflict处理
+	unlock := s.pathLocks.Lock(u.Path)
+	defer unlock()
+	exists := IsExists(dstPath)
+	if exists && u.Conflict == conflictReject {
+		s.tusUploads().Remove(u.ID)
+		return errFileExists
+	}
+	quotaPath := dstPath
+	if exists && u.Conflict == conflictRename {
+		quotaPath = renamedPath(dstPath)
+	}
+	usedSize, usedFiles, err := s.checkQuotaFile(auth, dst.File, quotaPath)
+	if err != nil {
+		s.tusUploads().Remove(u.ID)
+		return err
+	}
+	if u.Conflict != conflictReject && u.Conflict != conflictRename {
+		if _, err := s.archiveVersion(auth, dstPath); err != nil {
+			return err
+		}
+	}
+	if dstPath, err = commitUpload(dst, dstPath, u.Conflict); err != nil {
+		if err == errFileExists {
+			s.tusUploads().Remove(u.ID)
+		}
+		return err
+	}
+	s.addQuotaUsage(auth, usedSize, usedFiles)
+	setFileMeta(dstPath, &u.Meta)
+	log.Printf("tus upload %s finished: %s", u.ID, filepath.ToSlash(filepath.Join(filepath.Dir(u.Path), filepath.Base(dstPath))))
+	return s.tusUploads().Remove(u.ID)
+}
+
+// writeTusError uses the status of upload policy errors, other errors are internal
+func writeTusError(w http.ResponseWriter, err error) {
+	switch e := err.(type) {
+	case *S3APIError:
+		http.Error(w, e.Message, e.Status)
+	case *quotaError:
+		http.Error(w, e.Error(), http.StatusInsufficientStorage)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTusRequest(method, id string, body io.Reader) *http.Request {
+	req := httptest.NewRequest(method, "/-/tus/"+id, body)
+	req.Header.Set("Tus-Resumable", tusVersion)
+	return mux.SetURLVars(req, map[string]string{"id": id})
+}
+
+// createTusUpload returns the id of the new upload, "" if it fails
+func createTusUpload(t *testing.T, s *HTTPStaticServer, dir, filename string, length int) (int, string) {
+	t.Helper()
+	req := newTusRequest("POST", "", nil)
+	req.Header.Set("Upload-Length", strconv.Itoa(length))
+	req.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte(filename))+
+		",path "+base64.StdEncoding.EncodeToString([]byte(dir)))
+	w := serveTest(s.hTus, req)
+	return w.Code, strings.TrimPrefix(w.Header().Get("Location"), "/-/tus/")
+}
+
+func patchTusUpload(s *HTTPStaticServer, id string, offset int, data string) *httptest.ResponseRecorder {
+	req := newTusRequest("PATCH", id, strings.NewReader(data))
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	return serveTest(s.hTus, req)
+}
+
+func TestTusUpload(t *testing.T) {
+	s := newTestServer(t, map[string]string{"dir/a.txt": "old"})
+
+	code, id := createTusUpload(t, s, "dir", "a.txt", 11)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.NotEmpty(t, id)
+
+	w := serveTest(s.hTus, newTusRequest("HEAD", id, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "0", w.Header().Get("Upload-Offset"))
+	assert.Equal(t, "11", w.Header().Get("Upload-Length"))
+
+	w = patchTusUpload(s, id, 0, "hello")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "5", w.Header().Get("Upload-Offset"))
+	w = serveTest(s.hTus, newTusRequest("HEAD", id, nil))
+	assert.Equal(t, "5", w.Header().Get("Upload-Offset"))
+
+	// the client thinks the first chunk was lost
+	w = patchTusUpload(s, id, 0, "hello")
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, "old", readTestFile(s, "dir/a.txt"))
+
+	w = patchTusUpload(s, id, 5, " world")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "11", w.Header().Get("Upload-Offset"))
+	assert.Equal(t, "hello world", readTestFile(s, "dir/a.txt"))
+	w = serveTest(s.hTus, newTusRequest("HEAD", id, nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = serveTest(s.hTus, newTusRequest("HEAD", "nosuchid", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	req := newTusRequest("HEAD", id, nil)
+	req.Header.Del("Tus-Resumable")
+	assert.Equal(t, http.StatusPreconditionFailed, serveTest(s.hTus, req).Code)
+}
+
+func TestTusCreateChecksPath(t *testing.T) {
+	s := newTestServer(t, map[string]string{"dir/": ""})
+	for _, c := range []struct{ dir, filename string }{
+		{"dir", YAMLCONF},
+		{"dir", metaFileName},
+		{"dir/.ghs-versions/a.txt", "20200102T030405.000000006Z"},
+		{".ghs-trash/1", "a.txt"},
+		{"../dir", "a.txt"},
+	} {
+		code, _ := createTusUpload(t, s, c.dir, c.filename, 5)
+		assert.Contains(t, []int{http.StatusBadRequest, http.StatusForbidden}, code, c.dir+"/"+c.filename)
+	}
+	assert.False(t, testFileExists(s, "dir/"+YAMLCONF))
+	assert.False(t, testFileExists(s, "dir/.ghs-versions"))
+
+	writeTestFiles(t, s, map[string]string{"dir/" + YAMLCONF: "upload: true\nallowedExtensions: [.txt]\nmaxFileSize: 10\n"})
+	code, _ := createTusUpload(t, s, "dir", "a.exe", 5)
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = createTusUpload(t, s, "dir", "a.txt", 11)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, code)
+}
+
+func TestTusReap(t *testing.T) {
+	s := newTestServer(t, nil)
+	_, id := createTusUpload(t, s, "", "a.txt", 11)
+	assert.Equal(t, http.StatusNoContent, patchTusUpload(s, id, 0, "hello").Code)
+
+	count, _ := s.tusUploads().Reap(time.Now().Add(-time.Minute))
+	assert.Equal(t, 0, count)
+	count, reclaimed := s.tusUploads().Reap(time.Now().Add(time.Minute))
+	assert.Equal(t, 1, count)
+	assert.True(t, reclaimed >= 5)
+	assert.Equal(t, http.StatusNotFound, serveTest(s.hTus, newTusRequest("HEAD", id, nil)).Code)
+	assert.Equal(t, http.StatusNotFound, patchTusUpload(s, id, 5, " world").Code)
+	assert.False(t, testFileExists(s, "a.txt"))
+}
+
+func TestTusUploadConflict(t *testing.T) {
+	s := newTestServer(t, map[string]string{
+		"dir/a.txt":        "old",
+		"keep/" + YAMLCONF: "upload: true\nconflict: rename\n",
+		"keep/a.txt":       "old",
+	})
+	create := func(dir, conflict string) (int, string) {
+		req := newTusRequest("POST", "", nil)
+		req.Header.Set("Upload-Length", "3")
+		req.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte("a.txt"))+
+			",path "+base64.StdEncoding.EncodeToString([]byte(dir))+
+			",conflict "+base64.StdEncoding.EncodeToString([]byte(conflict)))
+		w := serveTest(s.hTus, req)
+		return w.Code, strings.TrimPrefix(w.Header().Get("Location"), "/-/tus/")
+	}
+
+	code, _ := create("dir", conflictReject)
+	assert.Equal(t, http.StatusConflict, code)
+	code, _ = create("dir", "nosuchpolicy")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// the file shows up while the upload is going on
+	code, id := create("dir", "")
+	assert.Equal(t, http.StatusCreated, code)
+	code, rejected := create("dir/new", conflictReject)
+	assert.Equal(t, http.StatusCreated, code)
+	writeTestFiles(t, s, map[string]string{"dir/new/a.txt": "other"})
+	assert.Equal(t, http.StatusConflict, patchTusUpload(s, rejected, 0, "new").Code)
+	assert.Equal(t, "other", readTestFile(s, "dir/new/a.txt"))
+	assert.Equal(t, http.StatusNotFound, serveTest(s.hTus, newTusRequest("HEAD", rejected, nil)).Code)
+
+	// overwrite by default as PUT does
+	assert.Equal(t, http.StatusNoContent, patchTusUpload(s, id, 0, "new").Code)
+	assert.Equal(t, "new", readTestFile(s, "dir/a.txt"))
+
+	// default of .ghs.yml
+	code, id = create("keep", "")
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, http.StatusNoContent, patchTusUpload(s, id, 0, "new").Code)
+	assert.Equal(t, "old", readTestFile(s, "keep/a.txt"))
+	assert.Equal(t, "new", readTestFile(s, "keep/a (1).txt"))
+
+	code, id = create("dir", conflictVersion)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, http.StatusNoContent, patchTusUpload(s, id, 0, "ver").Code)
+	assert.Equal(t, "ver", readTestFile(s, "dir/a.txt"))
+	if versions := listVersions(filepath.Join(s.Root, "dir/a.txt")); assert.Len(t, versions, 1) {
+		assert.Equal(t, int64(3), versions[0].Size)
+	}
+}
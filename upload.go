@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// uploadFile is a file to be saved by saveUpload
+type uploadFile struct {
+	Path        string // relative to root
+	Body        io.Reader
+	Size        int64 // -1 when unknown
+	ContentType string
+	Digests     []expectedDigest
+	Conflict    string // what to do if the file exists, empty for the default of .ghs.yml or the request method
+}
+
+// uploadResult is reported to the client for every saved file
+type uploadResult struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	MD5    string `json:"md5"`
+	SHA256 string `json:"sha256"`
+
+	Version    string `json:"version,omitempty"` // id of the kept previous version, see versions.go
+	reprDigest string
+}
+
+var errFileExists = &S3APIError{http.StatusConflict, "FileExists", "file already exists."}
+
+// conflict policies of uploads when the file exists
+const (
+	conflictReject    = "reject"
+	conflictOverwrite = "overwrite"
+	conflictRename    = "rename"  // save as "name (1).ext"
+	conflictVersion   = "version" // overwrite and keep the previous file in the version store
+)
+
+func checkConflict(conflict string) error {
+	switch conflict {
+	case "", conflictReject, conflictOverwrite, conflictRename, conflictVersion:
+		return nil
+	}
+	return &S3APIError{http.StatusBadRequest, "InvalidArgument", "conflict should be one of reject, overwrite, rename and version"}
+}
+
+// uploadConflict returns the conflict policy of the upload,
+// by default POST rejects and PUT overwrites unless .ghs.yml says otherwise
+func uploadConflict(req *http.Request, conflict string, auth AccessConf) string {
+	if conflict == "" {
+		conflict = auth.Conflict
+	}
+	if conflict == "" {
+		conflict = conflictOverwrite
+		if strings.ToUpper(req.Method) == "POST" {
+			conflict = conflictReject
+		}
+	}
+	return conflict
+}
+
+// renamedPath returns the first of "name (1).ext", "name (2).ext" ... which does not exist
+func renamedPath(path string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, i, ext)
+		if !IsExists(candidate) {
+			return candidate
+		}
+	}
+}
+
+// commitUpload commits p to dstPath with the conflict policy and returns where the file is saved.
+// Reject and rename never replace a file, not even one written by someone not holding the path lock.
+func commitUpload(p *PendingFile, dstPath, conflict string) (string, error) {
+	switch conflict {
+	case conflictReject:
+		err := p.CommitNew(dstPath)
+		if os.IsExist(err) {
+			err = errFileExists
+		}
+		return dstPath, err
+	case conflictRename:
+		// "name (1).ext"被别人抢先用了就接着找下一个
+		for path := dstPath; ; path = renamedPath(dstPath) {
+			if err := p.CommitNew(path); !os.IsExist(err) {
+				return path, err
+			}
+		}
+	}
+	return dstPath, p.CommitAs(dstPath)
+}
+
+// checkRelativePath checks every part of a path sent by the client, eg: webkitRelativePath of folder uploads
+func checkRelativePath(path string) error {
+	path = strings.Trim(filepath.ToSlash(path), "/")
+	if path == "" {
+		return errors.New("Invalid empty filename")
+	}
+	for _, name := range strings.Split(path, "/") {
+		if err := checkFilename(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveUpload writes one uploaded file with all the checks of .ghs.yml.
+// Data goes to a hidden temp file first, which is renamed into place only after everything is fine,
+// so an interrupted or rejected upload never touches the existing file.
+func (s *HTTPStaticServer) saveUpload(req *http.Request, f *uploadFile) (*uploadResult, error) {
+	path := multipartKey(f.Path)
+	filename := filepath.Base(path)
+	if err := checkFilename(filename); err != nil {
+		return nil, &S3APIError{http.StatusForbidden, "InvalidArgument", err.Error()}
+	}
+	auth := s.readAccessConf(path)
+	if !auth.canUpload(req) {
+		return nil, &S3APIError{http.StatusForbidden, "AccessDenied", "Upload forbidden"}
+	}
+	if err := checkConflict(auth.Conflict); err != nil {
+		return nil, err
+	}
+	conflict := uploadConflict(req, f.Conflict, auth)
+	if conflict == conflictVersion {
+		// 覆盖时保留旧文件，和目录开启了版本管理一样
+		auth.Versioning.Enable = true
+	}
+	dstPath := filepath.Join(s.Root, path)
+	if conflict == conflictReject && IsExists(dstPath) {
+		return nil, errFileExists
+	}
+
+	meta, err := fileMetaFromRequest(req, f.ContentType)
+	if err != nil {
+		return nil, &S3APIError{http.StatusBadRequest, "MetadataTooLarge", err.Error()}
+	}
+	// .ghs.yml中的上传限制，大小和扩展名能提前检查的先检查，内容类型要等文件写完
+	if err := auth.checkExtension(filename); err != nil {
+		return nil, err
+	}
+	if err := auth.checkFileSize(f.Size); err != nil {
+		return nil, err
+	}
+	if err := s.checkQuotaSize(auth, dstPath, f.Size); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dstPath), os.ModePerm); err != nil {
+		return nil, &S3APIError{http.StatusConflict, "InvalidRequest", "Cannot create directory. " + err.Error()}
+	}
+	if isDir(dstPath) {
+		return nil, &S3APIError{http.StatusConflict, "InvalidRequest", "A directory with the same name exists."}
+	}
+	dst, err := CreatePendingFile(dstPath)
+	if err != nil {
+		log.Println("Create file:", err)
+		return nil, errors.New("File create " + err.Error())
+	}
+	defer dst.Abort()
+	digester := newUploadDigester(f.Digests)
+	if _, err := io.Copy(io.MultiWriter(dst, digester.Writer()), auth.limitReader(f.Body)); err != nil {
+		log.Println("Handle upload file:", err)
+		return nil, err
+	}
+	if err := auth.checkUploadedFile(dst.File); err != nil {
+		return nil, err
+	}
+	// 校验失败的话临时文件直接丢弃，目标文件不受影响
+	if err := digester.Verify(); err != nil {
+		log.Println("Verify upload file:", err)
+		return nil, &S3APIError{http.StatusBadRequest, "BadDigest", err.Error()}
+	}
+
+	// 同一路径的rename要串行，非覆盖写期间别人写入的同名文件也不能被覆盖
+	unlock := s.pathLocks.Lock(path)
+	defer unlock()
+	exists := IsExists(dstPath)
+	if exists && conflict == conflictReject {
+		return nil, errFileExists
+	}
+	quotaPath := dstPath
+	if exists && conflict == conflictRename {
+		quotaPath = renamedPath(dstPath)
+	}
+	usedSize, usedFiles, err := s.checkQuotaFile(auth, dst.File, quotaPath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := dst.Stat()
+	if err != nil {
+		return nil, err
+	}
+	result := &uploadResult{Size: info.Size()}
+	// 目录开启了版本管理的话，覆盖也保留旧文件
+	if conflict != conflictReject && conflict != conflictRename {
+		if result.Version, err = s.archiveVersion(auth, dstPath); err != nil {
+			log.Println("Keep version:", err)
+			return nil, err
+		}
+	}
+	if dstPath, err = commitUpload(dst, dstPath, conflict); err != nil {
+		log.Println("Commit upload file:", err)
+		return nil, err
+	}
+	s.addQuotaUsage(auth, usedSize, usedFiles)
+	setFileMeta(dstPath, meta)
+
+	sums := digester.Sums()
+	result.Path = filepath.ToSlash(filepath.Join(filepath.Dir(path), filepath.Base(dstPath)))
+	result.MD5, result.SHA256 = sums["md5"], sums["sha256"]
+	result.reprDigest = digester.ReprDigest()
+	return result, nil
+}
+
+// uploadErrorJSON is the body of failed uploads, status comes from policy and quota errors, other failures are conflicts
+func uploadErrorJSON(err error) (int, map[string]interface{}) {
+	if e, ok := err.(*quotaError); ok {
+		return http.StatusInsufficientStorage, e.json()
+	}
+	status := http.StatusConflict
+	if e, ok := err.(*S3APIError); ok {
+		status = e.Status
+	}
+	return status, map[string]interface{}{
+		"success":     false,
+		"description": err.Error(),
+		"code":        status,
+	}
+}
+
+func writeUploadError(w http.ResponseWriter, err error) {
+	status, body := uploadErrorJSON(err)
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.Header().Set("Connection", "close")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// isFolderUpload reports whether the parsed multipart form comes with relative paths of its files,
+// eg: webkitRelativePath of files in a dropped or selected folder
+func isFolderUpload(req *http.Request) bool {
+	return req.MultipartForm != nil && len(folderRelativePaths(req.MultipartForm)) > 0
+}
+
+func folderRelativePaths(form *multipart.Form) []string {
+	if paths := form.Value["relativePath"]; len(paths) > 0 {
+		return paths
+	}
+	return form.Value["webkitRelativePath"]
+}
+
+// hUploadFolder saves every file of the form under dir at its relative path, missing directories are created.
+//
+//	curl -F file=@a/1.txt -F relativePath=a/1.txt -F file=@a/b/2.txt -F relativePath=a/b/2.txt localhost:8000/somedir
+func (s *HTTPStaticServer) hUploadFolder(w http.ResponseWriter, req *http.Request, dir string) {
+	files := req.MultipartForm.File["file"]
+	paths := folderRelativePaths(req.MultipartForm)
+	if len(files) == 0 || len(files) != len(paths) {
+		http.Error(w, "Every file should come with a relativePath", http.StatusBadRequest)
+		return
+	}
+	// 先检查所有路径，避免传了一半才发现有非法路径
+	for _, path := range paths {
+		if err := checkRelativePath(path); err != nil {
+			http.Error(w, path+": "+err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	// header里的checksum只能对应一个文件
+	var digests []expectedDigest
+	if len(files) == 1 {
+		var err error
+		if digests, err = parseUploadDigests(req, false); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	results := make([]*uploadResult, 0, len(files))
+	for i, header := range files {
+		path := filepath.Join(dir, paths[i])
+		result, err := s.saveFormFile(req, header, path, digests)
+		if err != nil {
+			// 已经保存的文件也要告诉客户端
+			status, body := uploadErrorJSON(err)
+			body["path"] = multipartKey(path)
+			body["files"] = results
+			w.Header().Set("Content-Type", "application/json;charset=utf-8")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(body)
+			return
+		}
+		results = append(results, result)
+	}
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"destination": dir,
+		"files":       results,
+	})
+}
+
+func (s *HTTPStaticServer) saveFormFile(req *http.Request, header *multipart.FileHeader, path string, digests []expectedDigest) (*uploadResult, error) {
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return s.saveUpload(req, &uploadFile{
+		Path:        path,
+		Body:        file,
+		Size:        header.Size,
+		ContentType: header.Header.Get("Content-Type"),
+		Digests:     digests,
+		Conflict:    req.URL.Query().Get("conflict"),
+	})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckRelativePath(t *testing.T) {
+	assert.NoError(t, checkRelativePath("a/b/c.txt"))
+	assert.NoError(t, checkRelativePath("/a/b/"))
+	assert.Error(t, checkRelativePath("a/../c.txt"))
+	assert.Error(t, checkRelativePath("a//c.txt"))
+	assert.Error(t, checkRelativePath(".ghs-versions/a.txt"))
+	assert.Error(t, checkRelativePath(""))
+}
+
+func TestCommitUpload(t *testing.T) {
+	s := newTestServer(t, map[string]string{"a.txt": "old", "a (1).txt": "taken"})
+	commit := func(name, conflict string) (string, error) {
+		f, err := CreatePendingFile(filepath.Join(s.Root, name))
+		assert.NoError(t, err)
+		defer f.Abort()
+		f.Write([]byte(conflict))
+		path, err := commitUpload(f, filepath.Join(s.Root, name), conflict)
+		return filepath.Base(path), err
+	}
+
+	_, err := commit("a.txt", conflictReject)
+	assert.Equal(t, errFileExists, err)
+	path, err := commit("a.txt", conflictRename)
+	assert.NoError(t, err)
+	assert.Equal(t, "a (2).txt", path)
+	path, err = commit("b.txt", conflictRename)
+	assert.NoError(t, err)
+	assert.Equal(t, "b.txt", path)
+	_, err = commit("a.txt", conflictOverwrite)
+	assert.NoError(t, err)
+	assert.Equal(t, "overwrite", readTestFile(s, "a.txt"))
+	assert.Equal(t, "taken", readTestFile(s, "a (1).txt"))
+	assertNoTempFiles(t, s.Root)
+
+	// concurrent renamed uploads get different names
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	names := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path, err := commit("c.txt", conflictRename)
+			assert.NoError(t, err)
+			mu.Lock()
+			names[path] = true
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, names, 10)
+}
+
+func TestRenamedPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghs-upload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), nil, 0644)
+	assert.Equal(t, filepath.Join(dir, "a (1).txt"), renamedPath(filepath.Join(dir, "a.txt")))
+	ioutil.WriteFile(filepath.Join(dir, "a (1).txt"), nil, 0644)
+	assert.Equal(t, filepath.Join(dir, "a (2).txt"), renamedPath(filepath.Join(dir, "a.txt")))
+	assert.Equal(t, filepath.Join(dir, "Makefile (1)"), renamedPath(filepath.Join(dir, "Makefile")))
+}
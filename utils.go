@@ -3,7 +3,12 @@ package main
 import (
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+
+	"github.com/alecthomas/units"
 )
 
 // func formatSize(file os.FileInfo) string {
@@ -71,3 +76,54 @@ func getLocalIP() string {
 	}
 	return ""
 }
+
+// diskUsage returns total size of regular files under path
+func diskUsage(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// ByteSize is a size in bytes, which can be written as 1048576, 1MB or 1MiB in config and flags.
+// Units are binary multiples, eg: 1KB = 1KiB = 1024
+type ByteSize int64
+
+func parseByteSize(s string) (ByteSize, error) {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ByteSize(n), nil
+	}
+	n, err := units.ParseBase2Bytes(s)
+	return ByteSize(n), err
+}
+
+// Set implements kingpin.Value
+func (b *ByteSize) Set(value string) error {
+	n, err := parseByteSize(value)
+	if err != nil {
+		return err
+	}
+	*b = n
+	return nil
+}
+
+func (b ByteSize) String() string {
+	return units.Base2Bytes(b).String()
+}
+
+func (b *ByteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	return b.Set(value)
+}
+
+func (b ByteSize) MarshalYAML() (interface{}, error) {
+	return b.String(), nil
+}
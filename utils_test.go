@@ -25,3 +25,45 @@ func TestSublimeContains(t *testing.T) {
 		}
 	}
 }
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		text string
+		size ByteSize
+	}{
+		{"1024", 1024},
+		{"512KB", 512 << 10},
+		{"5MiB", 5 << 20},
+		{"2GB", 2 << 30},
+	}
+	for _, v := range tests {
+		size, err := parseByteSize(v.text)
+		if err != nil || size != v.size {
+			t.Fatalf("Failed: %v - size:%v err:%v", v, size, err)
+		}
+	}
+	if _, err := parseByteSize("2 apples"); err == nil {
+		t.Fatal("Failed: invalid size should return error")
+	}
+}
+
+func TestIsSafePath(t *testing.T) {
+	tests := []struct {
+		path string
+		safe bool
+	}{
+		{"", true},
+		{"/", true},
+		{"foo/bar.txt", true},
+		{"/foo/..bar", true},
+		{"..", false},
+		{"../etc/passwd", false},
+		{"/foo/../../etc/passwd", false},
+		{"foo\\..\\bar", false},
+	}
+	for _, v := range tests {
+		if res := IsSafePath(v.path); res != v.safe {
+			t.Fatalf("Failed: %v - res:%v", v, res)
+		}
+	}
+}
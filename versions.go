@@ -0,0 +1,390 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// versionsDirName is the hidden directory in every directory keeping previous versions of its files,
+// versions of foo.txt are <dir>/.ghs-versions/foo.txt/<version id>
+const versionsDirName = ".ghs-versions"
+
+const versionIDFormat = "20060102T150405.000000000Z"
+
+// Versioning keeps overwritten and deleted files of the directory, set in .ghs.yml
+//
+//	versioning:
+//	  enable: true
+//	  maxVersions: 10 # of every file, 0 is unlimited
+//	  maxAge: 720h    # 0 keeps forever
+type Versioning struct {
+	Enable      bool          `yaml:"enable" json:"enable"`
+	MaxVersions int           `yaml:"maxVersions" json:"maxVersions,omitempty"`
+	MaxAge      time.Duration `yaml:"maxAge" json:"maxAge,omitempty"`
+}
+
+// FileVersion is a previous version of a file listed by ?op=versions
+type FileVersion struct {
+	ID          string `json:"id"`
+	Size        int64  `json:"size"`
+	ModTime     int64  `json:"mtime"`    // of the content, in milliseconds
+	ArchivedAt  int64  `json:"archived"` // when it was overwritten or deleted, in milliseconds
+	ContentType string `json:"contentType,omitempty"`
+	Uploader    string `json:"uploader,omitempty"`
+}
+
+func isVersionPath(path string) bool {
+	for _, name := range strings.Split(filepath.ToSlash(path), "/") {
+		if name == versionsDirName {
+			return true
+		}
+	}
+	return false
+}
+
+func fileVersionsDir(path string) string {
+	dir, name := filepath.Split(path)
+	return filepath.Join(dir, versionsDirName, name)
+}
+
+// parseVersionID returns when the version was archived, ok is false for anything not generated by keepVersion
+func parseVersionID(id string) (t time.Time, ok bool) {
+	t, err := time.Parse(versionIDFormat, id)
+	if err != nil || t.Format(versionIDFormat) != id {
+		return t, false
+	}
+	return t, true
+}
+
+// keepVersion saves the file at path into the version store together with its meta,
+// it returns the version id, or "" if there is no file at path.
+// The file itself stays in place, the caller replaces it with a rename or removes it,
+// so readers never miss it and it is not lost if the new file fails to be committed.
+// .ghs.yml is never kept, old tokens and secrets in it should not be readable as versions.
+func keepVersion(path string) (string, error) {
+	if isReadProtected(path) {
+		return "", nil
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	meta := getFileMeta(path, info)
+	dir := fileVersionsDir(path)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+	id := time.Now().UTC().Format(versionIDFormat)
+	versionPath := filepath.Join(dir, id)
+	// 文件总是rename覆盖而不是原地写，版本和当前文件可以共用数据；不支持硬链接的话复制一份
+	if err := os.Link(path, versionPath); err != nil {
+		if err := copyVersion(path, versionPath, info); err != nil {
+			return "", err
+		}
+	}
+	if meta != nil {
+		setFileMeta(versionPath, meta)
+	}
+	return id, nil
+}
+
+// copyVersion copies the file at path to versionPath keeping its mtime
+func copyVersion(path, versionPath string, info os.FileInfo) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := CreatePendingFile(versionPath)
+	if err != nil {
+		return err
+	}
+	defer dst.Abort()
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	}
+	if err := dst.Commit(); err != nil {
+		return err
+	}
+	return os.Chtimes(versionPath, info.ModTime(), info.ModTime())
+}
+
+// archiveVersion is called before the file at path is overwritten or deleted, nothing is kept unless versioning of ac is enabled.
+// Versions count against the quotas of ac, the ones removed by the retention limits are taken off.
+func (s *HTTPStaticServer) archiveVersion(ac AccessConf, path string) (string, error) {
+	if !ac.Versioning.Enable {
+		return "", nil
+	}
+	id, err := keepVersion(path)
+	if err != nil || id == "" {
+		return id, err
+	}
+	size, files := ac.Versioning.prune(path)
+	s.addQuotaUsage(ac, -size, -files)
+	return id, nil
+}
+
+// listVersions returns versions of the file at path, the newest first
+func listVersions(path string) []FileVersion {
+	dir := fileVersionsDir(path)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	versions := make([]FileVersion, 0, len(infos))
+	for _, info := range infos {
+		archived, ok := parseVersionID(info.Name())
+		if !ok || info.IsDir() {
+			continue
+		}
+		version := FileVersion{
+			ID:         info.Name(),
+			Size:       info.Size(),
+			ModTime:    info.ModTime().UnixNano() / 1e6,
+			ArchivedAt: archived.UnixNano() / 1e6,
+		}
+		if meta := getFileMeta(filepath.Join(dir, info.Name()), info); meta != nil {
+			version.ContentType = meta.ContentType
+			version.Uploader = meta.Uploader
+		}
+		versions = append(versions, version)
+	}
+	// id是固定格式的时间，按字符串排序就是按时间排序
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].ID > versions[j].ID
+	})
+	return versions
+}
+
+// expired reports whether the i-th newest version is beyond maxVersions or older than maxAge
+func (v Versioning) expired(i int, version FileVersion) bool {
+	return (v.MaxVersions > 0 && i >= v.MaxVersions) ||
+		(v.MaxAge > 0 && time.Since(time.Unix(0, version.ArchivedAt*1e6)) > v.MaxAge)
+}
+
+// prune removes versions of the file at path beyond maxVersions or older than maxAge,
+// it returns total size and count of the removed versions
+func (v Versioning) prune(path string) (size, files int64) {
+	if v.MaxVersions <= 0 && v.MaxAge <= 0 {
+		return
+	}
+	dir := fileVersionsDir(path)
+	versions := listVersions(path)
+	for i, version := range versions {
+		if v.expired(i, version) {
+			versionPath := filepath.Join(dir, version.ID)
+			if err := os.Remove(versionPath); err != nil {
+				log.Printf("Remove version %s: %v", versionPath, err)
+				continue
+			}
+			removeFileMeta(versionPath)
+			size += version.Size
+			files++
+		}
+	}
+	// 没有版本了就把空目录也删掉
+	if os.Remove(dir) == nil {
+		os.Remove(filepath.Dir(dir))
+	}
+	return
+}
+
+// pruneVersions applies the retention limits to versions in the directories, it runs with the index
+// so that versions of files which are never written again still expire
+func (s *HTTPStaticServer) pruneVersions(dirs []string) {
+	for _, dir := range dirs {
+		finfos, err := ioutil.ReadDir(filepath.Join(s.Root, dir, versionsDirName))
+		if err != nil {
+			continue
+		}
+		v := s.readAccessConf(dir).Versioning
+		for _, fi := range finfos {
+			v.prune(filepath.Join(s.Root, dir, fi.Name()))
+		}
+	}
+}
+
+// hVersions lists versions of a file, the file itself may have been deleted
+//
+//	GET /foo/app.apk?op=versions
+func (s *HTTPStaticServer) hVersions(w http.ResponseWriter, r *http.Request) {
+	path := mux.Vars(r)["path"]
+	auth := s.readAccessConf(path)
+	if !auth.canAccess(filepath.Base(path)) {
+		http.Error(w, "Access forbidden", http.StatusForbidden)
+		return
+	}
+	// 和直接访问.ghs-versions一样，只有能删除的人才能看
+	if isReadProtected(path) && !auth.canDelete(r) {
+		http.Error(w, "Security warning, not allowed to read", http.StatusForbidden)
+		return
+	}
+	relPath := filepath.Join(s.Root, path)
+	// 只在写入时清理，列出时跳过过期的版本
+	versions := make([]FileVersion, 0)
+	for i, version := range listVersions(relPath) {
+		if !auth.Versioning.expired(i, version) {
+			versions = append(versions, version)
+		}
+	}
+	if len(versions) == 0 && !isFile(relPath) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	data, _ := json.Marshal(map[string]interface{}{
+		"path":     path,
+		"exists":   isFile(relPath),
+		"versions": versions,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// hVersionDownload serves a previous version of a file with the name and meta it had
+//
+//	GET /foo/app.apk?version=20200102T030405.000000000Z
+func (s *HTTPStaticServer) hVersionDownload(w http.ResponseWriter, r *http.Request, id string) {
+	path := mux.Vars(r)["path"]
+	auth := s.readAccessConf(path)
+	if !auth.canAccess(filepath.Base(path)) {
+		http.Error(w, "Access forbidden", http.StatusForbidden)
+		return
+	}
+	// 和直接访问.ghs-versions一样，只有能删除的人才能看
+	if isReadProtected(path) && !auth.canDelete(r) {
+		http.Error(w, "Security warning, not allowed to read", http.StatusForbidden)
+		return
+	}
+	if _, ok := parseVersionID(id); !ok {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+	versionPath := filepath.Join(fileVersionsDir(filepath.Join(s.Root, path)), id)
+	f, err := os.Open(versionPath)
+	if err != nil {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if meta := getFileMeta(versionPath, info); meta != nil {
+		meta.setHeaders(w.Header())
+	}
+	w.Header().Set("X-Ghs-Version", id)
+	if r.FormValue("download") == "true" {
+		w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(filepath.Base(path)))
+	}
+	http.ServeContent(w, r, filepath.Base(path), info.ModTime(), f)
+}
+
+// hVersionRestore makes a previous version the current file again, the current one is kept as a new version
+//
+//	POST /foo/app.apk?op=restore&version=20200102T030405.000000000Z
+func (s *HTTPStaticServer) hVersionRestore(w http.ResponseWriter, req *http.Request) {
+	path := mux.Vars(req)["path"]
+	auth := s.readAccessConf(path)
+	if !auth.canUpload(req) {
+		http.Error(w, "Upload forbidden", http.StatusForbidden)
+		return
+	}
+	if isReadProtected(path) && !auth.canDelete(req) {
+		http.Error(w, "Security warning, not allowed to read", http.StatusForbidden)
+		return
+	}
+	id := req.URL.Query().Get("version")
+	if _, ok := parseVersionID(id); !ok {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+	dstPath := filepath.Join(s.Root, path)
+	versionPath := filepath.Join(fileVersionsDir(dstPath), id)
+	src, err := os.Open(versionPath)
+	if err != nil {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	meta := getFileMeta(versionPath, info)
+	// 旧版本可能是在上传限制之前存下的，恢复和上传一样要检查
+	if err := auth.checkExtension(filepath.Base(path)); err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	if err := auth.checkFileSize(info.Size()); err != nil {
+		writeUploadError(w, err)
+		return
+	}
+
+	// 版本本身保留，复制一份作为当前文件
+	dst, err := CreatePendingFile(dstPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer dst.Abort()
+	if _, err := io.Copy(dst, src); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := auth.checkUploadedFile(dst.File); err != nil {
+		writeUploadError(w, err)
+		return
+	}
+
+	// 当前文件总是作为新版本保留，目录没有开启版本管理也一样
+	auth.Versioning.Enable = true
+	unlock := s.pathLocks.Lock(multipartKey(path))
+	defer unlock()
+	if isDir(dstPath) {
+		writeUploadError(w, &S3APIError{http.StatusConflict, "InvalidRequest", "A directory with the same name exists."})
+		return
+	}
+	usedSize, usedFiles, err := s.checkQuotaFile(auth, dst.File, dstPath)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	previous, err := s.archiveVersion(auth, dstPath)
+	if err != nil {
+		log.Println("Keep version:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := dst.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.addQuotaUsage(auth, usedSize, usedFiles)
+	setFileMeta(dstPath, meta)
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"destination": path,
+		"version":     id,
+		"previous":    previous, // "" if the file had been deleted
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseVersionID(t *testing.T) {
+	id := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC).Format(versionIDFormat)
+	_, ok := parseVersionID(id)
+	assert.True(t, ok)
+	for _, id := range []string{"", "..", "../a.txt", "20200102T030405Z", id + "/x"} {
+		_, ok := parseVersionID(id)
+		assert.False(t, ok, id)
+	}
+}
+
+func TestVersioningKeep(t *testing.T) {
+	root, err := ioutil.TempDir("", "ghs-versions")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+	path := filepath.Join(root, "app.apk")
+
+	s := &HTTPStaticServer{Root: root}
+	v := Versioning{Enable: true, MaxVersions: 2}
+	for _, content := range []string{"v1", "v2", "v3"} {
+		// files are replaced, never written in place, versions share data with them
+		os.Remove(path)
+		ioutil.WriteFile(path, []byte(content), 0644)
+		id, err := s.archiveVersion(AccessConf{Versioning: v}, path)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, id)
+		time.Sleep(time.Millisecond)
+	}
+	assert.True(t, IsExists(path))
+
+	versions := listVersions(path)
+	if assert.Len(t, versions, 2) {
+		data, _ := ioutil.ReadFile(filepath.Join(fileVersionsDir(path), versions[0].ID))
+		assert.Equal(t, "v3", string(data))
+	}
+
+	// nothing to keep
+	os.Remove(path)
+	id, err := s.archiveVersion(AccessConf{Versioning: v}, path)
+	assert.NoError(t, err)
+	assert.Empty(t, id)
+
+	v.MaxAge = time.Nanosecond
+	size, files := v.prune(path)
+	assert.Equal(t, int64(4), size)
+	assert.Equal(t, int64(2), files)
+	assert.Empty(t, listVersions(path))
+	assert.False(t, IsExists(filepath.Join(root, versionsDirName)))
+}
+
+func TestVersionArchiveKeepsFile(t *testing.T) {
+	s := newTestServer(t, map[string]string{
+		"dir/" + YAMLCONF: "versioning:\n  enable: true\n",
+		"dir/a.txt":       "old",
+	})
+	path := filepath.Join(s.Root, "dir/a.txt")
+	auth := s.readAccessConf("dir/a.txt")
+
+	dst, err := CreatePendingFile(path)
+	assert.NoError(t, err)
+	dst.Write([]byte("new"))
+	id, err := s.archiveVersion(auth, path)
+	assert.NoError(t, err)
+	// still there for readers until the new file is committed
+	assert.Equal(t, "old", readTestFile(s, "dir/a.txt"))
+
+	// the commit fails, the file is not lost
+	os.Remove(dst.Name())
+	assert.Error(t, dst.Commit())
+	assert.Equal(t, "old", readTestFile(s, "dir/a.txt"))
+	assert.Equal(t, "old", readTestFile(s, "dir/"+versionsDirName+"/a.txt/"+id))
+
+	dst, err = CreatePendingFile(path)
+	assert.NoError(t, err)
+	dst.Write([]byte("new"))
+	_, err = s.archiveVersion(auth, path)
+	assert.NoError(t, err)
+	assert.NoError(t, dst.Commit())
+	assert.Equal(t, "new", readTestFile(s, "dir/a.txt"))
+	assert.Equal(t, "old", readTestFile(s, "dir/"+versionsDirName+"/a.txt/"+id))
+
+	// delete keeps the file as a version too
+	assert.NoError(t, s.deletePath(newTestRequest("DELETE", "/dir/a.txt", nil), "dir/a.txt"))
+	assert.False(t, testFileExists(s, "dir/a.txt"))
+	assert.Len(t, listVersions(path), 3)
+}
+
+func TestVersionsPruneOnWriteOnly(t *testing.T) {
+	old := time.Now().Add(-48 * time.Hour).UTC().Format(versionIDFormat)
+	recent := time.Now().UTC().Format(versionIDFormat)
+	s := newTestServer(t, map[string]string{
+		"dir/" + YAMLCONF: "versioning:\n  enable: true\n  maxAge: 24h\n",
+		"dir/a.txt":       "current",
+		"dir/" + versionsDirName + "/a.txt/" + recent: "recent",
+	})
+	writeTestFiles(t, s, map[string]string{"dir/" + versionsDirName + "/a.txt/" + old: "old"})
+
+	// listing hides expired versions without removing them
+	w := serveTest(s.hVersions, newTestRequest("GET", "/dir/a.txt?op=versions", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), recent)
+	assert.NotContains(t, w.Body.String(), old)
+	assert.True(t, testFileExists(s, "dir/"+versionsDirName+"/a.txt/"+old))
+
+	// rebuilding the index removes them
+	s.makeIndex()
+	assert.False(t, testFileExists(s, "dir/"+versionsDirName+"/a.txt/"+old))
+	assert.True(t, testFileExists(s, "dir/"+versionsDirName+"/a.txt/"+recent))
+}
+
+func TestVersionsReadProtected(t *testing.T) {
+	id := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC).Format(versionIDFormat)
+	s := newTestServer(t, map[string]string{
+		"dir/" + YAMLCONF:                          "delete: false\nversioning:\n  enable: true\nusers:\n- token: secret\n",
+		"dir/.ghs-versions/" + YAMLCONF + "/" + id: "users:\n- token: old-secret\n",
+		"admin/" + YAMLCONF:                        "versioning:\n  enable: true\n",
+	})
+
+	// .ghs.yml is never kept as a version
+	path := filepath.Join(s.Root, "dir", YAMLCONF)
+	version, err := keepVersion(path)
+	assert.NoError(t, err)
+	assert.Empty(t, version)
+	assert.True(t, IsExists(path))
+
+	w := serveTest(s.hVersions, newTestRequest("GET", "/dir/"+YAMLCONF+"?op=versions", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = httptest.NewRecorder()
+	s.hVersionDownload(w, newTestRequest("GET", "/dir/"+YAMLCONF+"?version="+id, nil), id)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.NotContains(t, w.Body.String(), "old-secret")
+	w = serveTest(s.hVersionRestore, newTestRequest("POST", "/dir/"+YAMLCONF+"?op=restore&version="+id, nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// deleting it in a versioned directory removes it instead of archiving
+	assert.NoError(t, s.deletePath(newTestRequest("DELETE", "/admin/"+YAMLCONF, nil), "admin/"+YAMLCONF))
+	assert.False(t, testFileExists(s, "admin/"+YAMLCONF))
+	assert.False(t, testFileExists(s, "admin/.ghs-versions"))
+}
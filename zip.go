@@ -95,6 +95,12 @@ func CompressToZip(w http.ResponseWriter, rootDir string) {
 		if info.Name() == YAMLCONF { // ignore .ghs.yml for security
 			return nil
 		}
+		if isInternalFile(info.Name()) { // files still being uploaded, meta database, old versions
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 		return zw.Add(zipPath, path)
 	})
 }
@@ -132,6 +138,27 @@ func ExtractFromZip(zipFile, path string, w io.Writer) (err error) {
 	return fmt.Errorf("File %s not found", strconv.Quote(path))
 }
 
+// unzipEntryName returns the name a zip entry is extracted to, ok is false for entries
+// which would write .ghs.yml or files managed by gohttpserver, in any directory
+func unzipEntryName(f *zip.File) (name string, ok bool) {
+	name = f.Name
+	// filename maybe GBK or UTF-8
+	// Ref: https://studygolang.com/articles/3114
+	if f.Flags&(1<<11) == 0 { // GBK
+		tr := simplifiedchinese.GB18030.NewDecoder()
+		if nameUtf8, err := tr.String(name); err == nil {
+			name = nameUtf8
+		}
+	}
+	name = sanitizedName(name)
+	for _, part := range strings.Split(filepath.ToSlash(name), "/") {
+		if part == ".." || part == YAMLCONF || isInternalFile(part) {
+			return "", false
+		}
+	}
+	return name, true
+}
+
 func unzipFile(filename, dest string) error {
 	zr, err := zip.OpenReader(filename)
 	if err != nil {
@@ -144,47 +171,71 @@ func unzipFile(filename, dest string) error {
 	}
 
 	for _, f := range zr.File {
-		rc, err := f.Open()
-		if err != nil {
-			return err
-		}
-		defer rc.Close()
-
-		// ignore .ghs.yml
-		filename := sanitizedName(f.Name)
-		if filepath.Base(filename) == ".ghs.yml" {
+		filename, ok := unzipEntryName(f)
+		if !ok {
 			continue
 		}
 		fpath := filepath.Join(dest, filename)
 
-		// filename maybe GBK or UTF-8
-		// Ref: https://studygolang.com/articles/3114
-		if f.Flags&(1<<11) == 0 { // GBK
-			tr := simplifiedchinese.GB18030.NewDecoder()
-			fpathUtf8, err := tr.String(fpath)
-			if err == nil {
-				fpath = fpathUtf8
-			}
-		}
-
 		if f.FileInfo().IsDir() {
 			os.MkdirAll(fpath, os.ModePerm)
 			continue
 		}
 
 		os.MkdirAll(filepath.Dir(fpath), os.ModePerm)
-		outMode := f.Mode()
-		outMode = outMode & ^os.ModeSymlink  // 不让在本地文件系统创建symbolic link
-		outFile, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, outMode)
-		if err != nil {
+		if err := unzipEntry(f, fpath); err != nil {
 			return err
 		}
-		_, err = io.Copy(outFile, rc)
-		outFile.Close()
+	}
+	return nil
+}
 
-		if err != nil {
-			return err
-		}
+// unzipEntry writes a file of the zip to a temp file which replaces fpath when it is complete.
+// An existing file is never written in place, it may share data with hard linked copies and versions.
+func unzipEntry(f *zip.File, fpath string) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	dst, err := CreatePendingFile(fpath)
+	if err != nil {
+		return err
+	}
+	defer dst.Abort()
+	if _, err := io.Copy(dst, rc); err != nil {
+		return err
+	}
+	if err := dst.Commit(); err != nil {
+		return err
+	}
+	// 不让在本地文件系统创建symbolic link，只保留权限位
+	if perm := f.Mode().Perm(); perm != 0644 && perm != 0 {
+		return os.Chmod(fpath, perm)
 	}
 	return nil
 }
+
+// unzipUsage returns total uncompressed size and file count unzipFile is going to write,
+// check is called with the name of every file to be written, which fails the whole unzip
+func unzipUsage(filename string, check func(name string, f *zip.File) error) (size, files int64, err error) {
+	zr, err := zip.OpenReader(filename)
+	if err != nil {
+		return
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		name, ok := unzipEntryName(f)
+		if !ok || f.FileInfo().IsDir() {
+			continue
+		}
+		if check != nil {
+			if err = check(filepath.ToSlash(name), f); err != nil {
+				return
+			}
+		}
+		size += int64(f.UncompressedSize64)
+		files++
+	}
+	return
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -18,3 +21,46 @@ func TestExtractFromZip(t *testing.T) {
 //	err := unzipFile("testdata.zip", "./tmp")
 //	assert.Nil(t, err)
 //}
+
+func TestUnzipSkipsInternalFiles(t *testing.T) {
+	dir := t.TempDir()
+	zipPath := filepath.Join(dir, "a.zip")
+	f, err := os.Create(zipPath)
+	assert.NoError(t, err)
+	zw := zip.NewWriter(f)
+	names := []string{
+		"a.txt",
+		"sub/" + YAMLCONF,
+		YAMLCONF + "/x.txt",
+		"sub/" + metaFileName,
+		versionsDirName + "/a.txt/v1",
+		"sub/" + trashDirName + "/1/info.json",
+		"sub/" + tempFilePrefix + "x",
+		"sub/../../escape.txt",
+	}
+	for _, name := range names {
+		w, _ := zw.CreateHeader(&zip.FileHeader{Name: name, Flags: 1 << 11})
+		w.Write([]byte("0123456789"))
+	}
+	zw.Close()
+	f.Close()
+
+	size, files, err := unzipUsage(zipPath, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), size)
+	assert.Equal(t, int64(1), files)
+
+	dest := filepath.Join(dir, "out")
+	assert.NoError(t, unzipFile(zipPath, dest))
+	var extracted []string
+	filepath.Walk(dest, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			rel, _ := filepath.Rel(dest, path)
+			extracted = append(extracted, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	assert.Equal(t, []string{"a.txt"}, extracted)
+	_, err = os.Stat(filepath.Join(dir, "escape.txt"))
+	assert.True(t, os.IsNotExist(err))
+}